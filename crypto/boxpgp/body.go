@@ -10,84 +10,158 @@ package boxpgp
 
 import "golang.org/x/crypto/openpgp"
 import "golang.org/x/crypto/openpgp/armor"
+import "golang.org/x/crypto/openpgp/packet"
 import message "github.com/emersion/go-message"
 import "bytes"
 import "io"
 import "io/ioutil"
+import "errors"
 
-import "github.com/dsnet/compress/bzip2"
+var (
+	ENotEnclosed = errors.New("Message is not encrypted by EncryptEMail")
+	EEnvelopeMismatch = errors.New("Encrypted envelope does not match the message")
+	EEnvelopeSigner = errors.New("Encrypted envelope is not signed by the signer of the message")
+)
 
 func EncryptMessage(raw []byte,keys []*openpgp.Entity) (result []byte,err error) {
+	return EncryptMessageSigned(raw,keys,nil)
+}
+
+/*
+Like EncryptMessage, but signs the message with signer, if not nil. The
+private key of signer must be decrypted.
+*/
+func EncryptMessageSigned(raw []byte,keys []*openpgp.Entity,signer *openpgp.Entity) (result []byte,err error) {
 	wr0 := new(bytes.Buffer)
-	wr1,e := armor.Encode(wr0,"ENCLOSED-OPGP",make(map[string]string))
-	if e!=nil { err = e ; return }
-	wr2,e := openpgp.Encrypt(wr1,keys, nil, nil, nil)
-	if e!=nil { err = e ; return }
-	wr3,e := bzip2.NewWriter(wr2,&bzip2.WriterConfig{Level:9})
+	w,e := NewEncryptWriterSigned(wr0,keys,signer)
 	if e!=nil { err = e ; return }
-	_,err = wr3.Write(raw)
+	_,err = w.Write(raw)
 	if err!=nil { return }
-	err = wr3.Close()
-	if err!=nil { return }
-	err = wr2.Close()
-	if err!=nil { return }
-	err = wr1.Close()
+	err = w.Close()
 	if err!=nil { return }
 	result = wr0.Bytes()
 	return
 }
 
-func decryptMessage(body io.Reader,keys openpgp.KeyRing) (blk *armor.Block,err error) {
-	blk,err = armor.Decode(body)
-	if err!=nil { return }
-	m,e := openpgp.ReadMessage(blk.Body, keys, nil, nil)
+func DecryptMessage(body io.Reader,keys openpgp.KeyRing) (result []byte,err error) {
+	r,e := NewDecryptReader(body,keys)
 	if e!=nil { err = e; return }
-	blk.Body,err = bzip2.NewReader(m.UnverifiedBody,new(bzip2.ReaderConfig))
-	return
+	return ioutil.ReadAll(r)
 }
 
-func DecryptMessage(body io.Reader,keys openpgp.KeyRing) (result []byte,err error) {
-	blk,e := decryptMessage(body,keys)
+/*
+Like DecryptMessage, but also checks the signature. The public key of the
+signer must be in keys.
+*/
+func DecryptMessageVerified(body io.Reader,keys openpgp.KeyRing) (result []byte,v *Verification,err error) {
+	r,e := NewDecryptReader(body,keys)
 	if e!=nil { err = e; return }
-	return ioutil.ReadAll(blk.Body)
+	result,err = ioutil.ReadAll(r)
+	if err!=nil { result = nil; return }
+	v,err = r.Verify()
+	if err!=nil { result = nil }
+	return
 }
 
 func EncryptEMail(raw []byte,hdr message.Header,keys []*openpgp.Entity) (result *message.Entity,err error) {
+	return EncryptEMailSigned(raw,hdr,keys,nil)
+}
+
+/*
+Like EncryptEMail, but signs the envelope and the body with signer, if not
+nil.
+*/
+func EncryptEMailSigned(raw []byte,hdr message.Header,keys []*openpgp.Entity,signer *openpgp.Entity) (result *message.Entity,err error) {
 	msg,e := message.Read(bytes.NewReader(raw))
 	if e!=nil { err = e ; return }
 	if hdr==nil { hdr = make(message.Header) }
-	err = EncodeHeader(hdr,msg.Header,keys)
+	err = EncodeHeaderSigned(hdr,msg.Header,keys,signer)
+	if err!=nil { return }
 	hdr.Set("Subject","<Enclosed-H>")
 	hdr.Set("X-Encrypted","ENCLOSED-OPGP")
-	wr0 := new(bytes.Buffer)
-	wr1,e := armor.Encode(wr0,"ENCLOSED-OPGP",make(map[string]string))
-	if e!=nil { err = e ; return }
-	wr2,e := openpgp.Encrypt(wr1,keys, nil, nil, nil)
-	if e!=nil { err = e ; return }
-	wr3,e := bzip2.NewWriter(wr2,&bzip2.WriterConfig{Level:9})
-	if e!=nil { err = e ; return }
-	_,err = wr3.Write(raw)
+	enc,err := EncryptMessageSigned(raw,keys,signer)
 	if err!=nil { return }
-	err = wr3.Close()
-	if err!=nil { return }
-	err = wr2.Close()
+	return message.New(hdr,bytes.NewReader(enc))
+}
+
+/*
+Decrypts a message created by EncryptEMail and returns the original message.
+The encrypted envelope must match the headers of the enclosed message.
+*/
+func DecryptEMail(msg *message.Entity,keys openpgp.KeyRing) (result *message.Entity,err error) {
+	raw,err := DecryptEMailRaw(msg,keys)
 	if err!=nil { return }
-	err = wr1.Close()
+	return message.Read(bytes.NewReader(raw))
+}
+
+/*
+Like DecryptEMail, but returns the original message as it was passed to
+EncryptEMail.
+*/
+func DecryptEMailRaw(msg *message.Entity,keys openpgp.KeyRing) (raw []byte,err error) {
+	raw,_,err = decryptEMail(msg,keys,false)
+	return
+}
+
+/*
+Like DecryptEMailRaw, but also checks the signatures. The public key of the
+signer must be in keys. v is the verification of the body; it is only valid if
+the envelope is validly signed by the same key.
+*/
+func DecryptEMailVerified(msg *message.Entity,keys openpgp.KeyRing) (raw []byte,v *Verification,err error) {
+	return decryptEMail(msg,keys,true)
+}
+
+func decryptEMail(msg *message.Entity,keys openpgp.KeyRing,verified bool) (raw []byte,v *Verification,err error) {
+	if msg.Header.Get("X-Encrypted")!="ENCLOSED-OPGP" { err = ENotEnclosed; return }
+	var env message.Header
+	var ve *Verification
+	if verified {
+		env,ve,err = DecodeHeaderVerified(msg.Header,keys)
+		if err!=nil { return }
+		raw,v,err = DecryptMessageVerified(msg.Body,keys)
+	} else {
+		env,err = DecodeHeader(msg.Header,keys)
+		if err!=nil { return }
+		raw,err = DecryptMessage(msg.Body,keys)
+	}
 	if err!=nil { return }
-	lr := 0
-	ovh := 0
-	for k,vv := range hdr {
-		ovh = len(k)+4 // ^<Key>: <Value>\r\n$
-		for _,v := range vv { lr+= ovh+len(v) }
+	inner,e := message.Read(bytes.NewReader(raw))
+	if e!=nil { raw = nil; v = nil; err = e; return }
+	for k,vv := range env {
+		if !equalValues(vv,inner.Header[k]) { raw = nil; v = nil; err = EEnvelopeMismatch; return }
 	}
-	//hdr.Set("X-Size",fmt.Sprintf("%d",len(raw)))
-	/*
-	if lr>wr0.Len() {
-		hdr.Set("Subject","<Enclosed-B>")
-		delete(hdr,XPgpEnvelope)
+	if v!=nil && v.Valid && !(ve.Valid && ve.KeyId==v.KeyId) {
+		v.Valid = false
+		v.Err = ve.Err
+		if v.Err==nil { v.Err = EEnvelopeSigner }
 	}
-	*/
-	result,err = message.New(hdr,wr0)
 	return
 }
 
+/*
+Reports whether msg is a message created by EncryptEMail for one of keys: it
+has the X-Encrypted header, and its body is an OpenPGP message, that is
+encrypted to one of keys. Nothing is decrypted, so public keys suffice.
+*/
+func IsEnclosed(msg *message.Entity,keys openpgp.KeyRing) bool {
+	if msg.Header.Get("X-Encrypted")!="ENCLOSED-OPGP" { return false }
+	blk,err := armor.Decode(msg.Body)
+	if err!=nil || blk.Type!="ENCLOSED-OPGP" { return false }
+	r := packet.NewReader(blk.Body)
+	for {
+		p,err := r.Next()
+		if err!=nil { return false }
+		ek,ok := p.(*packet.EncryptedKey)
+		if !ok { return false }
+		if len(keys.KeysById(ek.KeyId))>0 { return true }
+	}
+}
+
+func equalValues(a, b []string) bool {
+	if len(a)!=len(b) { return false }
+	for i := range a {
+		if a[i]!=b[i] { return false }
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package boxpgp
+
+import "golang.org/x/crypto/openpgp"
+import message "github.com/emersion/go-message"
+import "bytes"
+import "io/ioutil"
+import "testing"
+
+const testMail = "From: alice@example.org\r\nTo: bob@example.org\r\nSubject: secret subject\r\nMessage-Id: <1@example.org>\r\nDate: Mon, 1 Jan 2018 12:00:00 +0000\r\n\r\nsecret body\r\n"
+
+/*
+Serializes a message, as an IMAP server would store it. The body of e is
+consumed.
+*/
+func serialize(t *testing.T,e *message.Entity) []byte {
+	buf := new(bytes.Buffer)
+	err := e.WriteTo(buf)
+	if err!=nil { t.Fatal(err) }
+	return buf.Bytes()
+}
+
+func parse(t *testing.T,raw []byte) *message.Entity {
+	e,err := message.Read(bytes.NewReader(raw))
+	if err!=nil { t.Fatal(err) }
+	return e
+}
+
+func TestDecryptEMail(t *testing.T) {
+	bob := testKey(t,"bob@example.org")
+	enc,err := EncryptEMail([]byte(testMail),nil,[]*openpgp.Entity{bob})
+	if err!=nil { t.Fatal(err) }
+	if enc.Header.Get("Subject")!="<Enclosed-H>" || enc.Header.Get("From")!="" { t.Fatalf("header leaks: %v",enc.Header) }
+	
+	stored := serialize(t,enc)
+	dec,err := DecryptEMail(parse(t,stored),openpgp.EntityList{bob})
+	if err!=nil { t.Fatal(err) }
+	if dec.Header.Get("Subject")!="secret subject" || dec.Header.Get("Message-Id")!="<1@example.org>" { t.Fatalf("header %v",dec.Header) }
+	body,err := ioutil.ReadAll(dec.Body)
+	if err!=nil { t.Fatal(err) }
+	if string(body)!="secret body\r\n" { t.Fatalf("body %q",body) }
+	
+	raw,err := DecryptEMailRaw(parse(t,stored),openpgp.EntityList{bob})
+	if err!=nil { t.Fatal(err) }
+	if string(raw)!=testMail { t.Fatalf("raw %q",raw) }
+}
+
+func TestDecryptEMailMismatch(t *testing.T) {
+	bob := testKey(t,"bob@example.org")
+	enc,err := EncryptEMail([]byte(testMail),nil,[]*openpgp.Entity{bob})
+	if err!=nil { t.Fatal(err) }
+	
+	// An envelope taken from another message.
+	other := make(message.Header)
+	other.Set("From","alice@example.org")
+	other.Set("Subject","harmless subject")
+	err = EncodeHeader(enc.Header,other,[]*openpgp.Entity{bob})
+	if err!=nil { t.Fatal(err) }
+	if _,err = DecryptEMail(parse(t,serialize(t,enc)),openpgp.EntityList{bob}); err!=EEnvelopeMismatch { t.Fatal(err) }
+	
+	if _,err = DecryptEMail(parse(t,[]byte(testMail)),openpgp.EntityList{bob}); err!=ENotEnclosed { t.Fatal(err) }
+}
+
+func TestIsEnclosed(t *testing.T) {
+	bob := testKey(t,"bob@example.org")
+	alice := testKey(t,"alice@example.org")
+	enc,err := EncryptEMail([]byte(testMail),nil,[]*openpgp.Entity{bob})
+	if err!=nil { t.Fatal(err) }
+	stored := serialize(t,enc)
+	
+	// The public key is enough.
+	public := &openpgp.Entity{PrimaryKey:bob.PrimaryKey,Identities:bob.Identities,Subkeys:bob.Subkeys}
+	if !IsEnclosed(parse(t,stored),openpgp.EntityList{public}) { t.Error("sealed message") }
+	if IsEnclosed(parse(t,stored),openpgp.EntityList{alice}) { t.Error("sealed for another key") }
+	if IsEnclosed(parse(t,[]byte("X-Encrypted: ENCLOSED-OPGP\r\n"+testMail)),openpgp.EntityList{bob}) { t.Error("header only") }
+	if IsEnclosed(parse(t,[]byte(testMail)),openpgp.EntityList{bob}) { t.Error("plaintext") }
+}
+
+func TestDecryptEMailVerified(t *testing.T) {
+	bob := testKey(t,"bob@example.org")
+	alice := testKey(t,"alice@example.org")
+	mallory := testKey(t,"mallory@example.org")
+	keys := openpgp.EntityList{alice,bob,mallory}
+	enc,err := EncryptEMailSigned([]byte(testMail),nil,[]*openpgp.Entity{bob},alice)
+	if err!=nil { t.Fatal(err) }
+	stored := serialize(t,enc)
+	raw,v,err := DecryptEMailVerified(parse(t,stored),keys)
+	if err!=nil { t.Fatal(err) }
+	if string(raw)!=testMail { t.Fatalf("raw %q",raw) }
+	if !v.Valid || v.Signer.PrimaryKey.KeyId!=alice.PrimaryKey.KeyId { t.Fatalf("verification %+v",v) }
+	
+	// An envelope signed by someone else.
+	msg := parse(t,stored)
+	inner := parse(t,[]byte(testMail))
+	err = EncodeHeaderSigned(msg.Header,inner.Header,[]*openpgp.Entity{bob},mallory)
+	if err!=nil { t.Fatal(err) }
+	_,v,err = DecryptEMailVerified(msg,keys)
+	if err!=nil { t.Fatal(err) }
+	if v.Valid || v.Err!=EEnvelopeSigner { t.Fatalf("verification %+v",v) }
+	
+	enc,err = EncryptEMail([]byte(testMail),nil,[]*openpgp.Entity{bob})
+	if err!=nil { t.Fatal(err) }
+	_,v,err = DecryptEMailVerified(parse(t,serialize(t,enc)),keys)
+	if err!=nil { t.Fatal(err) }
+	if v.Signed || v.Valid { t.Fatalf("unsigned: %+v",v) }
+}
@@ -0,0 +1,42 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package boxpgp
+
+import pgperrs "golang.org/x/crypto/openpgp/errors"
+import "io"
+
+/*
+Reports whether err means, that no usable key was found: the key is wrong,
+revoked or unknown.
+*/
+func IsKeyError(err error) bool {
+	switch err {
+	case pgperrs.ErrKeyIncorrect,pgperrs.ErrKeyRevoked,pgperrs.ErrUnknownIssuer: return true
+	}
+	return false
+}
+
+/*
+Reports whether err means, that an OpenPGP message is malformed, truncated or
+not supported. Unlike other errors, retrying does not help.
+*/
+func IsStructuralError(err error) bool {
+	switch err {
+	case io.EOF,io.ErrUnexpectedEOF: return true
+	}
+	switch err.(type) {
+	case	pgperrs.InvalidArgumentError,
+		pgperrs.SignatureError,
+		pgperrs.StructuralError,
+		pgperrs.UnknownPacketTypeError,
+		pgperrs.UnsupportedError:
+		return true
+	}
+	return false
+}
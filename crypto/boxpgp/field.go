@@ -0,0 +1,59 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package boxpgp
+
+import "bytes"
+import "net/textproto"
+
+/*
+A header field with its continuation lines, as they appear in the message.
+*/
+type HeaderField struct{
+	Name string // canonical
+	Lines []byte
+}
+
+/*
+Reports whether name is a valid header field name (RFC 5322: printable ASCII,
+except the colon).
+*/
+func validFieldName(name []byte) bool {
+	if len(name)==0 { return false }
+	for _,c := range name {
+		if c<33 || c>126 || c==':' { return false }
+	}
+	return true
+}
+
+/*
+Splits a message into its header fields, in their original order, and its
+body. The header ends at the blank line, or at the first line that is neither
+a field nor a continuation line; that line is part of the body.
+*/
+func SplitHeader(msg []byte) (fields []HeaderField, body []byte) {
+	pos := 0
+	for pos<len(msg) {
+		end := bytes.IndexByte(msg[pos:],'\n')
+		if end<0 { end = len(msg) } else { end += pos+1 }
+		line := msg[pos:end]
+		if len(bytes.TrimRight(line,"\r\n"))==0 { pos = end; break }
+		if (line[0]==' ' || line[0]=='\t') && len(fields)>0 {
+			fields[len(fields)-1].Lines = append(fields[len(fields)-1].Lines,line...)
+		} else {
+			i := bytes.IndexByte(line,':')
+			if i<0 { break }
+			name := bytes.TrimRight(line[:i]," \t")
+			if !validFieldName(name) { break }
+			fields = append(fields,HeaderField{textproto.CanonicalMIMEHeaderKey(string(name)),append([]byte(nil),line...)})
+		}
+		pos = end
+	}
+	body = msg[pos:]
+	return
+}
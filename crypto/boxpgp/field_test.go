@@ -0,0 +1,28 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package boxpgp
+
+import "strings"
+import "testing"
+
+func TestSplitHeader(t *testing.T) {
+	for _,c := range []struct{ msg string; names []string; body string }{
+		{"Subject: a\r\n folded\r\nTo: b\r\n\r\nbody\r\n",[]string{"Subject","To"},"body\r\n"},
+		{"Subject : a\n\nbody\n",[]string{"Subject"},"body\n"},
+		{"Subject: a\r\nnot a header\r\nTo: b\r\n",[]string{"Subject"},"not a header\r\nTo: b\r\n"},
+		{"Subject: a\r\nbad name: b\r\n",[]string{"Subject"},"bad name: b\r\n"},
+		{" continued\r\nSubject: a\r\n",nil," continued\r\nSubject: a\r\n"},
+		{"::\r\nAnon-To: a@example.org\r\n",nil,"::\r\nAnon-To: a@example.org\r\n"},
+	} {
+		fields,body := SplitHeader([]byte(c.msg))
+		var names []string
+		for _,f := range fields { names = append(names,f.Name) }
+		if strings.Join(names," ")!=strings.Join(c.names," ") || string(body)!=c.body { t.Errorf("%q: %v, body %q",c.msg,names,body) }
+	}
+}
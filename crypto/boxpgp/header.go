@@ -46,6 +46,13 @@ func log16(i int) (j int) {
 Encrypts the Envelope part of the header.
 */
 func EncodeHeader(target, source message.Header,keys []*openpgp.Entity) (err error) {
+	return EncodeHeaderSigned(target,source,keys,nil)
+}
+
+/*
+Like EncodeHeader, but signs the envelope with signer, if not nil.
+*/
+func EncodeHeaderSigned(target, source message.Header,keys []*openpgp.Entity,signer *openpgp.Entity) (err error) {
 	var result []string
 	h := source
 	comp := make([][]string,len(envHeaders))
@@ -54,7 +61,7 @@ func EncodeHeader(target, source message.Header,keys []*openpgp.Entity) (err err
 	}
 	buf := new(bytes.Buffer)
 	enc := base64.NewEncoder(base64.RawStdEncoding,buf)
-	w,e := openpgp.Encrypt(enc, keys, nil, nil, nil)// &openpgp.FileHints{IsBinary:true}
+	w,e := openpgp.Encrypt(enc, keys, signer, nil, nil)// &openpgp.FileHints{IsBinary:true}
 	if e!=nil { err = e; return }
 	w2,e := flate.NewWriter(w,9)
 	if e!=nil { err = e; return }
@@ -83,6 +90,23 @@ func EncodeHeader(target, source message.Header,keys []*openpgp.Entity) (err err
 Decrypts the envelope part of the header.
 */
 func DecodeHeader(source message.Header,keys openpgp.KeyRing) (target message.Header, err error) {
+	target,_,err = decodeHeader(source,keys)
+	return
+}
+
+/*
+Like DecodeHeader, but also checks the signature. The public key of the
+signer must be in keys.
+*/
+func DecodeHeaderVerified(source message.Header,keys openpgp.KeyRing) (target message.Header, v *Verification, err error) {
+	target,md,err := decodeHeader(source,keys)
+	if err!=nil { return }
+	v,err = verify(md)
+	if err!=nil { target = nil }
+	return
+}
+
+func decodeHeader(source message.Header,keys openpgp.KeyRing) (target message.Header, md *openpgp.MessageDetails, err error) {
 	buf := new(bytes.Buffer)
 	elems := make(map[int]string)
 	
@@ -100,10 +124,11 @@ func DecodeHeader(source message.Header,keys openpgp.KeyRing) (target message.He
 	}
 	
 	r := base64.NewDecoder(base64.RawStdEncoding,buf)
-	m,e := openpgp.ReadMessage(r, keys, nil, nil)
-	if e!=nil { err = e; return }
+	md,err = openpgp.ReadMessage(r, keys, nil, nil)
+	if err!=nil { return }
+	md.UnverifiedBody = &eofReader{r:md.UnverifiedBody}
 	
-	r2 := flate.NewReader(m.UnverifiedBody)
+	r2 := flate.NewReader(md.UnverifiedBody)
 	defer r2.Close()
 	
 	var result [][]string
@@ -0,0 +1,154 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package boxpgp
+
+import message "github.com/emersion/go-message"
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "mime"
+import "net/mail"
+import "strings"
+import "unicode"
+
+const XPgpIndexPrefix = "X-Pgp-Index-"
+
+/*
+The headers, that are covered by the blind index. Each of them is indexed in
+a header named XPgpIndexPrefix+name.
+*/
+var indexHeaders = []string{
+	"From",
+	"To",
+	"Cc",
+	"Bcc",
+	"Message-Id",
+	"Subject",
+}
+
+/*
+Returns the names of the index headers.
+*/
+func IndexHeaderNames() (names []string) {
+	for _,n := range indexHeaders { names = append(names,XPgpIndexPrefix+n) }
+	return
+}
+
+var indexWordDecoder = new(mime.WordDecoder)
+
+/*
+Computes the token of a normalized value. The name of the header is part of
+the MAC, so equal values in different headers are not linkable.
+*/
+func indexToken(key []byte,name,value string) string {
+	m := hmac.New(sha256.New,key)
+	m.Write([]byte(strings.ToLower(name)))
+	m.Write([]byte{0})
+	m.Write([]byte(value))
+	return hex.EncodeToString(m.Sum(nil)[:12])
+}
+
+func normalizeMessageId(v string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(v),"<"),">")
+}
+
+// A domain is indexed in the form "@example.org".
+func addressTerms(addr string) []string {
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	i := strings.LastIndexByte(addr,'@')
+	if i<0 { return []string{addr} }
+	return []string{addr,addr[i:]}
+}
+
+func subjectTerms(v string) []string {
+	if d,err := indexWordDecoder.DecodeHeader(v); err==nil { v = d }
+	return strings.FieldsFunc(strings.ToLower(v),func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+/*
+Returns the normalized terms of the values of a header.
+*/
+func indexTerms(name string,values []string) (terms []string) {
+	for _,v := range values {
+		switch name {
+		case "Message-Id":
+			terms = append(terms,normalizeMessageId(v))
+		case "Subject":
+			terms = append(terms,subjectTerms(v)...)
+		default:
+			list,err := mail.ParseAddressList(v)
+			if err!=nil { continue }
+			for _,a := range list { terms = append(terms,addressTerms(a.Address)...) }
+		}
+	}
+	return
+}
+
+/*
+Adds a keyed blind index of the envelope in source to target, so that the
+upstream server can search encrypted messages (see IndexQuery) without
+learning the plaintext. The index only matches whole addresses, domains,
+Message-Ids and subject words.
+
+The key must be kept as secret as the private key.
+*/
+func IndexHeader(target, source message.Header,key []byte) {
+	for _,n := range indexHeaders {
+		name := XPgpIndexPrefix+n
+		max := 78-(len(name)+2) // ^<Key>: <Value>$
+		seen := make(map[string]bool)
+		line := ""
+		for _,t := range indexTerms(n,source[n]) {
+			if t=="" || seen[t] { continue }
+			seen[t] = true
+			tok := indexToken(key,n,t)
+			if line!="" && len(line)+1+len(tok)>max {
+				target[name] = append(target[name],line)
+				line = ""
+			}
+			if line!="" { line += " " }
+			line += tok
+		}
+		if line!="" { target[name] = append(target[name],line) }
+	}
+}
+
+/*
+Turns a plaintext search on a header into index lookups. It returns the name
+of the index header and the tokens, that must all be contained in it. A
+search for an address without local part (like "example.org") matches the
+domain. If the header is not indexed, name is empty.
+*/
+func IndexQuery(key []byte,header,query string) (name string,tokens []string) {
+	var n string
+	for _,h := range indexHeaders {
+		if strings.EqualFold(h,header) { n = h }
+	}
+	if n=="" { return }
+	var terms []string
+	switch n {
+	case "Message-Id":
+		terms = []string{normalizeMessageId(query)}
+	case "Subject":
+		terms = subjectTerms(query)
+	default:
+		q := strings.ToLower(normalizeMessageId(query))
+		if strings.IndexByte(q,'@')<=0 { q = "@"+strings.TrimPrefix(q,"@") }
+		terms = []string{q}
+	}
+	for _,t := range terms {
+		if t=="" { continue }
+		tokens = append(tokens,indexToken(key,n,t))
+	}
+	if len(tokens)==0 { return }
+	name = XPgpIndexPrefix+n
+	return
+}
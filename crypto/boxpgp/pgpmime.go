@@ -0,0 +1,258 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package boxpgp
+
+import "golang.org/x/crypto/openpgp"
+import "golang.org/x/crypto/openpgp/armor"
+import "golang.org/x/crypto/openpgp/packet"
+import message "github.com/emersion/go-message"
+import "net/textproto"
+import "bufio"
+import "bytes"
+import "encoding/base64"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "mime"
+import "net/mail"
+import "strings"
+
+var (
+	ENotPGPMIME = errors.New("Message is not PGP/MIME encrypted")
+)
+
+/*
+Headers, that are removed from the outer header of a PGP/MIME message. The
+Subject is replaced with "[...]" (the hcp_baseline policy of RFC 9788).
+*/
+var obscuredHeaders = []string{
+	"Comments",
+	"Keywords",
+}
+
+func isContentHeader(k string) bool {
+	return strings.HasPrefix(k,"Content-") || k=="Mime-Version"
+}
+
+/*
+Returns the value of an Autocrypt header field (Autocrypt Level 1), that
+announces the public key of e for addr. The key data is folded into lines of
+76 characters.
+*/
+func AutocryptHeader(addr string,e *openpgp.Entity,mutual bool) (string,error) {
+	key := new(bytes.Buffer)
+	err := e.Serialize(key)
+	if err!=nil { return "",err }
+	kd := base64.StdEncoding.EncodeToString(key.Bytes())
+	v := new(bytes.Buffer)
+	fmt.Fprintf(v,"addr=%s;",addr)
+	if mutual { v.WriteString(" prefer-encrypt=mutual;") }
+	v.WriteString(" keydata=")
+	for len(kd)>0 {
+		n := 76
+		if n>len(kd) { n = len(kd) }
+		v.WriteString("\r\n ")
+		v.WriteString(kd[:n])
+		kd = kd[n:]
+	}
+	return v.String(),nil
+}
+
+/*
+Returns the address of the From field, if e has a user id for it.
+*/
+func autocryptAddr(from string,e *openpgp.Entity) string {
+	a,err := mail.ParseAddress(from)
+	if err!=nil { return "" }
+	for _,id := range e.Identities {
+		if strings.EqualFold(id.UserId.Email,a.Address) { return a.Address }
+	}
+	return ""
+}
+
+func splitMessage(raw []byte) (h textproto.MIMEHeader,body []byte,err error) {
+	r := bufio.NewReader(bytes.NewReader(raw))
+	h,err = textproto.NewReader(r).ReadMIMEHeader()
+	if err==io.EOF && len(h)!=0 { err = nil }
+	if err!=nil { return }
+	body,err = ioutil.ReadAll(r)
+	return
+}
+
+/*
+Encrypts a message into a PGP/MIME message (RFC 3156), that can be read by
+common mail clients. The complete header is protected by moving it into the
+encrypted part (RFC 9788).
+*/
+func EncryptPGPMIME(raw []byte,keys []*openpgp.Entity) (result *message.Entity,err error) {
+	return EncryptPGPMIMESigned(raw,keys,nil)
+}
+
+/*
+Like EncryptPGPMIME, but signs the message with signer, if not nil. The
+public key of the signer is announced in an Autocrypt header, if it has a user
+id for the From address.
+*/
+func EncryptPGPMIMESigned(raw []byte,keys []*openpgp.Entity,signer *openpgp.Entity) (result *message.Entity,err error) {
+	h,_,err := splitMessage(raw)
+	if err!=nil { return }
+	fields,body := SplitHeader(raw)
+	
+	outer := make(message.Header)
+	for k,v := range h {
+		if isContentHeader(k) { continue }
+		outer[k] = v
+	}
+	for _,k := range obscuredHeaders { outer.Del(k) }
+	if _,ok := outer["Subject"]; ok { outer.Set("Subject","[...]") }
+	
+	// The cryptographic payload carries the full header in its original order,
+	// followed by the HP-Outer fields, that record the outer header.
+	ct,params,e := mime.ParseMediaType(h.Get("Content-Type"))
+	if e!=nil { ct,params = "text/plain",map[string]string{"charset":"us-ascii"} }
+	params["hp"] = "cipher"
+	ctField := "Content-Type: "+mime.FormatMediaType(ct,params)+"\r\n"
+	payload := new(bytes.Buffer)
+	for _,f := range fields {
+		switch f.Name {
+		case "Mime-Version": continue
+		case "Content-Type": payload.WriteString(ctField); ctField = ""; continue
+		}
+		payload.Write(f.Lines)
+	}
+	payload.WriteString(ctField)
+	seen := make(map[string]bool)
+	for _,f := range fields {
+		if seen[f.Name] { continue }
+		seen[f.Name] = true
+		for _,v := range outer[f.Name] { fmt.Fprintf(payload,"HP-Outer: %s: %s\r\n",f.Name,v) }
+	}
+	payload.WriteString("\r\n")
+	payload.Write(body)
+	
+	enc := new(bytes.Buffer)
+	wr1,err := armor.Encode(enc,"PGP MESSAGE",make(map[string]string))
+	if err!=nil { return }
+	wr2,err := openpgp.Encrypt(wr1,keys,signer,nil,&packet.Config{DefaultCompressionAlgo:packet.CompressionZLIB})
+	if err!=nil { return }
+	_,err = wr2.Write(payload.Bytes())
+	if err!=nil { return }
+	err = wr2.Close()
+	if err!=nil { return }
+	err = wr1.Close()
+	if err!=nil { return }
+	enc.WriteString("\r\n")
+	
+	if signer!=nil {
+		if addr := autocryptAddr(h.Get("From"),signer); addr!="" {
+			ac,err := AutocryptHeader(addr,signer,false)
+			if err!=nil { return nil,err }
+			outer.Set("Autocrypt",ac)
+		}
+	}
+	outer.Set("Mime-Version","1.0")
+	outer.SetContentType("multipart/encrypted",map[string]string{"protocol":"application/pgp-encrypted"})
+	
+	vh := make(message.Header)
+	vh.SetContentType("application/pgp-encrypted",nil)
+	vh.Set("Content-Description","PGP/MIME version identification")
+	version,err := message.New(vh,strings.NewReader("Version: 1\r\n"))
+	if err!=nil { return }
+	
+	dh := make(message.Header)
+	dh.SetContentType("application/octet-stream",map[string]string{"name":"encrypted.asc"})
+	dh.Set("Content-Description","OpenPGP encrypted message")
+	dh.Set("Content-Disposition","inline; filename=\"encrypted.asc\"")
+	data,err := message.New(dh,enc)
+	if err!=nil { return }
+	
+	return message.NewMultipart(outer,[]*message.Entity{version,data})
+}
+
+/*
+Decrypts a PGP/MIME message, as it is stored. If the encrypted part carries
+protected headers (RFC 9788), they replace the outer header, otherwise the
+outer header is used. The header keeps its order; HP-Outer fields are removed.
+*/
+func DecryptPGPMIME(stored []byte,keys openpgp.KeyRing) (result *message.Entity,err error) {
+	raw,err := DecryptPGPMIMERaw(stored,keys)
+	if err!=nil { return }
+	return message.Read(bytes.NewReader(raw))
+}
+
+/*
+Like DecryptPGPMIME, but returns the decrypted message unparsed.
+*/
+func DecryptPGPMIMERaw(stored []byte,keys openpgp.KeyRing) (raw []byte,err error) {
+	raw,_,err = decryptPGPMIME(stored,keys)
+	return
+}
+
+/*
+Like DecryptPGPMIMERaw, but also checks the signature. The public key of the
+signer must be in keys.
+*/
+func DecryptPGPMIMEVerified(stored []byte,keys openpgp.KeyRing) (raw []byte,v *Verification,err error) {
+	raw,md,err := decryptPGPMIME(stored,keys)
+	if err!=nil { return }
+	v,err = verify(md)
+	if err!=nil { raw = nil }
+	return
+}
+
+func decryptPGPMIME(stored []byte,keys openpgp.KeyRing) (raw []byte,md *openpgp.MessageDetails,err error) {
+	msg,err := message.Read(bytes.NewReader(stored))
+	if err!=nil { return }
+	ct,params,e := msg.Header.ContentType()
+	if e!=nil || ct!="multipart/encrypted" || params["protocol"]!="application/pgp-encrypted" { err = ENotPGPMIME; return }
+	mr := msg.MultipartReader()
+	if mr==nil { err = ENotPGPMIME; return }
+	defer mr.Close()
+	
+	// The first part only holds the version identification.
+	p,err := mr.NextPart()
+	if err!=nil { return }
+	if ct,_,_ = p.Header.ContentType(); ct!="application/pgp-encrypted" { err = ENotPGPMIME; return }
+	p,err = mr.NextPart()
+	if err!=nil { return }
+	
+	blk,err := armor.Decode(p.Body)
+	if err!=nil { return }
+	if blk.Type!="PGP MESSAGE" { err = ENotPGPMIME; return }
+	md,err = openpgp.ReadMessage(blk.Body,keys,nil,nil)
+	if err!=nil { return }
+	md.UnverifiedBody = &eofReader{r:md.UnverifiedBody}
+	payload,err := ioutil.ReadAll(md.UnverifiedBody)
+	if err!=nil { return }
+	
+	h,_,err := splitMessage(payload)
+	if err!=nil { return }
+	fields,body := SplitHeader(payload)
+	buf := new(bytes.Buffer)
+	outer := make(map[string]bool)
+	_,params,_ = mime.ParseMediaType(h.Get("Content-Type"))
+	if params["hp"]=="" && params["protected-headers"]=="" {
+		// No protected headers: the outer header applies.
+		outerFields,_ := SplitHeader(stored)
+		for _,f := range outerFields {
+			if isContentHeader(f.Name) { continue }
+			outer[f.Name] = true
+			buf.Write(f.Lines)
+		}
+	}
+	for _,f := range fields {
+		if f.Name=="Hp-Outer" || outer[f.Name] { continue }
+		buf.Write(f.Lines)
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	raw = buf.Bytes()
+	return
+}
@@ -0,0 +1,87 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package boxpgp
+
+import "golang.org/x/crypto/openpgp"
+import "golang.org/x/crypto/openpgp/armor"
+import "bytes"
+import "encoding/base64"
+import "io/ioutil"
+import "strings"
+import "testing"
+
+const testTrace = "Received: from b.example.org by c.example.org\r\nReceived: from a.example.org by b.example.org\r\nFrom: alice@example.org\r\nTo: bob@example.org\r\nKeywords: secret\r\nSubject: secret subject\r\nContent-Type: text/plain; charset=utf-8\r\nMime-Version: 1.0\r\n\r\nsecret body\r\n"
+
+/*
+Decrypts the cryptographic payload of a serialized PGP/MIME message.
+*/
+func pgpPayload(t *testing.T,raw []byte,keys openpgp.KeyRing) string {
+	i := bytes.Index(raw,[]byte("-----BEGIN PGP MESSAGE-----"))
+	if i<0 { t.Fatal("no encrypted part") }
+	blk,err := armor.Decode(bytes.NewReader(raw[i:]))
+	if err!=nil { t.Fatal(err) }
+	md,err := openpgp.ReadMessage(blk.Body,keys,nil,nil)
+	if err!=nil { t.Fatal(err) }
+	payload,err := ioutil.ReadAll(md.UnverifiedBody)
+	if err!=nil { t.Fatal(err) }
+	return string(payload)
+}
+
+func TestPGPMIME(t *testing.T) {
+	bob := testKey(t,"bob@example.org")
+	alice := testKey(t,"alice@example.org")
+	enc,err := EncryptPGPMIMESigned([]byte(testTrace),[]*openpgp.Entity{bob},alice)
+	if err!=nil { t.Fatal(err) }
+	if enc.Header.Get("Subject")!="[...]" || enc.Header.Get("Keywords")!="" { t.Fatalf("header leaks: %v",enc.Header) }
+	
+	// The Autocrypt header announces the key of the sender.
+	ac := enc.Header.Get("Autocrypt")
+	if !strings.HasPrefix(ac,"addr=alice@example.org; keydata=") { t.Fatalf("Autocrypt %q",ac) }
+	kd,err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(ac[len("addr=alice@example.org; keydata="):]),""))
+	if err!=nil { t.Fatal(err) }
+	el,err := openpgp.ReadKeyRing(bytes.NewReader(kd))
+	if err!=nil || len(el)!=1 || el[0].PrimaryKey.KeyId!=alice.PrimaryKey.KeyId { t.Fatal("keydata",el,err) }
+	
+	stored := serialize(t,enc)
+	payload := pgpPayload(t,stored,openpgp.EntityList{bob})
+	for _,f := range []string{"HP-Outer: Subject: [...]\r\n","HP-Outer: From: alice@example.org\r\n","HP-Outer: Received: from a.example.org by b.example.org\r\n"} {
+		if !strings.Contains(payload,f) { t.Errorf("payload lacks %q",f) }
+	}
+	if strings.Contains(payload,"HP-Outer: Keywords:") { t.Error("removed field recorded as outer") }
+	
+	raw,v,err := DecryptPGPMIMEVerified(stored,openpgp.EntityList{alice,bob})
+	if err!=nil { t.Fatal(err) }
+	if v.Signer.PrimaryKey.KeyId!=alice.PrimaryKey.KeyId { t.Fatal("signed by",v.Signer) }
+	want := strings.Replace(testTrace,"charset=utf-8","charset=utf-8; hp=cipher",1)
+	want = strings.Replace(want,"Mime-Version: 1.0\r\n","",1)
+	if string(raw)!=want { t.Fatalf("decrypted %q",raw) }
+}
+
+func TestPGPMIMEWithoutProtectedHeaders(t *testing.T) {
+	bob := testKey(t,"bob@example.org")
+	enc := new(bytes.Buffer)
+	wr1,err := armor.Encode(enc,"PGP MESSAGE",nil)
+	if err!=nil { t.Fatal(err) }
+	wr2,err := openpgp.Encrypt(wr1,[]*openpgp.Entity{bob},nil,nil,nil)
+	if err!=nil { t.Fatal(err) }
+	_,err = wr2.Write([]byte("Content-Type: text/plain\r\nX-Inner: 1\r\n\r\nsecret body\r\n"))
+	if err!=nil { t.Fatal(err) }
+	wr2.Close()
+	wr1.Close()
+	
+	// A message of a client, that does not protect the header.
+	stored := "Received: from a.example.org by b.example.org\r\nSubject: hello\r\nFrom: alice@example.org\r\nMime-Version: 1.0\r\n"+
+		"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"b\"\r\n\r\n"+
+		"--b\r\nContent-Type: application/pgp-encrypted\r\n\r\nVersion: 1\r\n\r\n"+
+		"--b\r\nContent-Type: application/octet-stream\r\n\r\n"+enc.String()+"\r\n--b--\r\n"
+	raw,err := DecryptPGPMIMERaw([]byte(stored),openpgp.EntityList{bob})
+	if err!=nil { t.Fatal(err) }
+	want := "Received: from a.example.org by b.example.org\r\nSubject: hello\r\nFrom: alice@example.org\r\nContent-Type: text/plain\r\nX-Inner: 1\r\n\r\nsecret body\r\n"
+	if string(raw)!=want { t.Fatalf("decrypted %q",raw) }
+}
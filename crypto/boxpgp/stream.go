@@ -0,0 +1,91 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package boxpgp
+
+import "golang.org/x/crypto/openpgp"
+import "golang.org/x/crypto/openpgp/armor"
+import "io"
+
+import "github.com/dsnet/compress/bzip2"
+
+type encryptWriter struct{
+	wr1, wr2 io.WriteCloser
+	wr3 *bzip2.Writer
+}
+
+func (e *encryptWriter) Write(p []byte) (int,error) { return e.wr3.Write(p) }
+
+/*
+Flushes the compressor, the encryption and the armor. The underlying writer
+is not closed.
+*/
+func (e *encryptWriter) Close() error {
+	err := e.wr3.Close()
+	if err!=nil { return err }
+	err = e.wr2.Close()
+	if err!=nil { return err }
+	return e.wr1.Close()
+}
+
+/*
+Returns a writer that compresses, encrypts and armors everything written to
+it into w, in the format of EncryptMessage. Close must be called to complete
+the message.
+*/
+func NewEncryptWriter(w io.Writer,keys []*openpgp.Entity) (io.WriteCloser,error) {
+	return NewEncryptWriterSigned(w,keys,nil)
+}
+
+/*
+Like NewEncryptWriter, but signs the message with signer, if not nil.
+*/
+func NewEncryptWriterSigned(w io.Writer,keys []*openpgp.Entity,signer *openpgp.Entity) (io.WriteCloser,error) {
+	wr1,err := armor.Encode(w,"ENCLOSED-OPGP",make(map[string]string))
+	if err!=nil { return nil,err }
+	wr2,err := openpgp.Encrypt(wr1,keys, signer, nil, nil)
+	if err!=nil { return nil,err }
+	wr3,err := bzip2.NewWriter(wr2,&bzip2.WriterConfig{Level:9})
+	if err!=nil { return nil,err }
+	return &encryptWriter{wr1,wr2,wr3},nil
+}
+
+/*
+Reads the plaintext of a message in the format of EncryptMessage.
+*/
+type DecryptReader struct{
+	r io.Reader
+	md *openpgp.MessageDetails
+}
+
+/*
+Returns a reader that decodes the armor and decrypts and decompresses the
+message from r.
+*/
+func NewDecryptReader(r io.Reader,ring openpgp.KeyRing) (*DecryptReader,error) {
+	blk,err := armor.Decode(r)
+	if err!=nil { return nil,err }
+	md,err := openpgp.ReadMessage(blk.Body, ring, nil, nil)
+	if err!=nil { return nil,err }
+	md.UnverifiedBody = &eofReader{r:md.UnverifiedBody}
+	br,err := bzip2.NewReader(md.UnverifiedBody,new(bzip2.ReaderConfig))
+	if err!=nil { return nil,err }
+	return &DecryptReader{br,md},nil
+}
+
+/*
+Reads the plaintext. Until Verify has succeeded, the plaintext is not
+authenticated.
+*/
+func (d *DecryptReader) Read(p []byte) (int,error) { return d.r.Read(p) }
+
+/*
+Checks the signature. It must be called after the plaintext has been read.
+The public key of the signer must be in the key ring.
+*/
+func (d *DecryptReader) Verify() (*Verification,error) { return verify(d.md) }
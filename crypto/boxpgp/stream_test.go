@@ -0,0 +1,51 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package boxpgp
+
+import "golang.org/x/crypto/openpgp"
+import "bytes"
+import "fmt"
+import "io/ioutil"
+import "testing"
+
+func TestStreamRoundTrip(t *testing.T) {
+	bob := testKey(t,"bob@example.org")
+	alice := testKey(t,"alice@example.org")
+	plain := new(bytes.Buffer)
+	for i := 0; plain.Len()<1<<20; i++ { fmt.Fprintf(plain,"line %d of a long message\r\n",i) }
+	
+	// Written in pieces, as a stream.
+	enc := new(bytes.Buffer)
+	w,err := NewEncryptWriterSigned(enc,[]*openpgp.Entity{bob},alice)
+	if err!=nil { t.Fatal(err) }
+	for data := plain.Bytes(); len(data)>0; {
+		n := 4093
+		if n>len(data) { n = len(data) }
+		_,err = w.Write(data[:n])
+		if err!=nil { t.Fatal(err) }
+		data = data[n:]
+	}
+	err = w.Close()
+	if err!=nil { t.Fatal(err) }
+	if !bytes.HasPrefix(enc.Bytes(),[]byte("-----BEGIN ENCLOSED-OPGP-----")) { t.Fatalf("armor %.40q",enc.Bytes()) }
+	if enc.Len()>plain.Len()/2 { t.Errorf("not compressed: %d bytes",enc.Len()) }
+	
+	r,err := NewDecryptReader(bytes.NewReader(enc.Bytes()),openpgp.EntityList{alice,bob})
+	if err!=nil { t.Fatal(err) }
+	dec,err := ioutil.ReadAll(r)
+	if err!=nil { t.Fatal(err) }
+	if !bytes.Equal(dec,plain.Bytes()) { t.Fatalf("decrypted %d bytes, want %d",len(dec),plain.Len()) }
+	v,err := r.Verify()
+	if err!=nil { t.Fatal(err) }
+	if !v.Valid || v.Signer.PrimaryKey.KeyId!=alice.PrimaryKey.KeyId { t.Fatalf("verification %+v",v) }
+	
+	// DecryptMessage reads the same format.
+	dec,err = DecryptMessage(bytes.NewReader(enc.Bytes()),openpgp.EntityList{bob})
+	if err!=nil || !bytes.Equal(dec,plain.Bytes()) { t.Fatal("DecryptMessage:",len(dec),err) }
+}
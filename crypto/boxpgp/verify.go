@@ -0,0 +1,69 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package boxpgp
+
+import "golang.org/x/crypto/openpgp"
+import pgperrs "golang.org/x/crypto/openpgp/errors"
+import "io"
+import "io/ioutil"
+
+/*
+The result of the signature check of a decrypted message.
+*/
+type Verification struct{
+	// True if the message is signed.
+	Signed bool
+	
+	// The key id of the signer, if Signed.
+	KeyId uint64
+	
+	// The signer, if its key is known.
+	Signer *openpgp.Entity
+	
+	// True if the signature is valid.
+	Valid bool
+	
+	// Why the signature is not valid. pgperrs.ErrUnknownIssuer if the key
+	// of the signer is not known.
+	Err error
+}
+
+/*
+Remembers EOF. The openpgp reader checks the signature again if it is read
+after EOF, which fails.
+*/
+type eofReader struct{
+	r io.Reader
+	eof bool
+}
+func (e *eofReader) Read(p []byte) (n int,err error) {
+	if e.eof { return 0,io.EOF }
+	n,err = e.r.Read(p)
+	if err==io.EOF { e.eof = true }
+	return
+}
+
+/*
+Checks the signature. The signature is only known after the whole message
+has been read, so the remaining data is consumed. md.UnverifiedBody must be
+wrapped in an *eofReader.
+*/
+func verify(md *openpgp.MessageDetails) (v *Verification,err error) {
+	_,err = io.Copy(ioutil.Discard,md.UnverifiedBody)
+	if err!=nil { return }
+	v = &Verification{Signed:md.IsSigned,KeyId:md.SignedByKeyId}
+	if !md.IsSigned { return }
+	if md.SignedBy!=nil { v.Signer = md.SignedBy.Entity }
+	switch {
+	case md.SignedBy==nil: v.Err = pgperrs.ErrUnknownIssuer
+	case md.SignatureError!=nil: v.Err = md.SignatureError
+	default: v.Valid = true
+	}
+	return
+}
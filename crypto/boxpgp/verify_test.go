@@ -0,0 +1,83 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package boxpgp
+
+import "golang.org/x/crypto/openpgp"
+import pgperrs "golang.org/x/crypto/openpgp/errors"
+import message "github.com/emersion/go-message"
+import "bytes"
+import _ "crypto/sha256"
+import "testing"
+
+var testEntities = make(map[string]*openpgp.Entity)
+
+/*
+Returns a key pair for the given address. Keys are generated once per test
+binary, since RSA key generation is slow. The self-signature is made again
+with a SHA-256 preference, as openpgp.Encrypt() wants RIPEMD-160 otherwise.
+*/
+func testKey(t *testing.T,email string) *openpgp.Entity {
+	if e,ok := testEntities[email]; ok { return e }
+	e,err := openpgp.NewEntity("test","",email,nil)
+	if err!=nil { t.Fatal(err) }
+	for _,id := range e.Identities {
+		id.SelfSignature.PreferredHash = []uint8{8} // SHA-256
+		err = id.SelfSignature.SignUserId(id.UserId.Id,e.PrimaryKey,e.PrivateKey,nil)
+		if err!=nil { t.Fatal(err) }
+	}
+	testEntities[email] = e
+	return e
+}
+
+func TestSignedMessage(t *testing.T) {
+	bob := testKey(t,"bob@example.org")
+	alice := testKey(t,"alice@example.org")
+	raw := []byte("Subject: hi\r\n\r\nsigned text\r\n")
+	
+	enc,err := EncryptMessageSigned(raw,[]*openpgp.Entity{bob},alice)
+	if err!=nil { t.Fatal(err) }
+	dec,v,err := DecryptMessageVerified(bytes.NewReader(enc),openpgp.EntityList{bob,alice})
+	if err!=nil { t.Fatal(err) }
+	if !bytes.Equal(dec,raw) { t.Fatalf("plaintext %q",dec) }
+	if !v.Signed || !v.Valid || v.Signer!=alice || v.KeyId!=alice.PrimaryKey.KeyId { t.Fatalf("verification %+v",v) }
+	
+	// The signer is not known.
+	_,v,err = DecryptMessageVerified(bytes.NewReader(enc),openpgp.EntityList{bob})
+	if err!=nil { t.Fatal(err) }
+	if !v.Signed || v.Valid || v.Err!=pgperrs.ErrUnknownIssuer { t.Fatalf("verification %+v",v) }
+	
+	enc,err = EncryptMessage(raw,[]*openpgp.Entity{bob})
+	if err!=nil { t.Fatal(err) }
+	dec,v,err = DecryptMessageVerified(bytes.NewReader(enc),openpgp.EntityList{bob,alice})
+	if err!=nil || !bytes.Equal(dec,raw) { t.Fatal(dec,err) }
+	if v.Signed || v.Valid { t.Fatalf("unsigned message: %+v",v) }
+}
+
+func TestSignedHeader(t *testing.T) {
+	bob := testKey(t,"bob@example.org")
+	alice := testKey(t,"alice@example.org")
+	src := make(message.Header)
+	src.Set("From","alice@example.org")
+	src.Set("Subject","secret subject")
+	src.Set("Message-Id","<1@example.org>")
+	
+	enc := make(message.Header)
+	err := EncodeHeaderSigned(enc,src,[]*openpgp.Entity{bob},alice)
+	if err!=nil { t.Fatal(err) }
+	if len(enc[XPgpEnvelope])==0 { t.Fatal("no envelope") }
+	for _,line := range enc[XPgpEnvelope] {
+		if len(line)+len(XPgpEnvelope)+2>78 { t.Fatalf("overlong envelope line %q",line) }
+	}
+	dec,v,err := DecodeHeaderVerified(enc,openpgp.EntityList{bob,alice})
+	if err!=nil { t.Fatal(err) }
+	for _,k := range []string{"From","Subject","Message-Id"} {
+		if dec.Get(k)!=src.Get(k) { t.Errorf("%s: %q",k,dec.Get(k)) }
+	}
+	if !v.Valid || v.Signer!=alice { t.Fatalf("verification %+v",v) }
+}
@@ -0,0 +1,78 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package dialer
+
+import "crypto/tls"
+import "net"
+import "strings"
+
+/*
+The connection settings of a mail protocol client. The protocol packages
+(imapio, pop3io, nntpio) define their Connector on top of this type and add
+the protocol specific STARTTLS and login.
+*/
+type Connector struct{
+	Dialer Dialer // nil means direct.
+	Addr string
+	
+	// TLS configuration. If ServerName is empty, the host part of Addr is used.
+	TLS *tls.Config
+	
+	// If set, TLS is negotiated using the STARTTLS command of the protocol.
+	// Otherwise Implicit TLS is used, unless NoTLS is set.
+	StartTLS bool
+	NoTLS bool
+	
+	Username, Password string
+}
+
+/*
+Returns a copy of the TLS configuration with ServerName filled in.
+*/
+func (c *Connector) TLSConfig() *tls.Config {
+	config := new(tls.Config)
+	if c.TLS!=nil { config = c.TLS.Clone() }
+	if config.ServerName=="" {
+		host,_,err := net.SplitHostPort(c.Addr)
+		if err!=nil { host = c.Addr }
+		config.ServerName = host
+	}
+	return config
+}
+
+/*
+Reports, whether TLS must be negotiated with STARTTLS after the greeting.
+*/
+func (c *Connector) NeedStartTLS() bool {
+	return !c.NoTLS && c.StartTLS
+}
+
+/*
+Dials Addr and performs the TLS handshake, if Implicit TLS is used.
+*/
+func (c *Connector) Dial() (net.Conn,error) {
+	conn,err := Or(c.Dialer).Dial("tcp",c.Addr)
+	if err!=nil { return nil,err }
+	if c.NoTLS || c.StartTLS { return conn,nil }
+	tc := tls.Client(conn,c.TLSConfig())
+	err = tc.Handshake()
+	if err!=nil { conn.Close(); return nil,err }
+	return tc,nil
+}
+
+/*
+Reports, whether a capability list (as returned by the POP3 CAPA or the NNTP
+CAPABILITIES command) contains name. Keywords are case-insensitive.
+*/
+func HasCapability(capa []string, name string) bool {
+	for _,line := range capa {
+		if strings.EqualFold(strings.SplitN(line," ",2)[0],name) { return true }
+	}
+	return false
+}
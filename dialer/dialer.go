@@ -0,0 +1,114 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+// Pluggable dialers for upstream connections (direct, SOCKS5/Tor, HTTP CONNECT).
+package dialer
+
+import "golang.org/x/net/proxy"
+import "net"
+import "net/http"
+import "net/url"
+import "bufio"
+import "encoding/base64"
+import "fmt"
+import "time"
+
+type Dialer interface{
+	Dial(network, addr string) (net.Conn, error)
+}
+
+/*
+Returns d, or a direct dialer if d is nil.
+*/
+func Or(d Dialer) Dialer {
+	if d==nil { return Direct{} }
+	return d
+}
+
+/*
+Connects directly to the destination.
+*/
+type Direct struct{
+	Timeout time.Duration
+}
+func (d Direct) Dial(network, addr string) (net.Conn, error) {
+	return net.DialTimeout(network,addr,d.Timeout)
+}
+
+/*
+Connects through a SOCKS5 proxy such as Tor. Host names are resolved by the
+proxy.
+
+If Isolate is set, every destination gets its own credentials, so that Tor
+(with IsolateSOCKSAuth, the default) uses a separate circuit per destination.
+*/
+type SOCKS5 struct{
+	Addr string
+	Auth *proxy.Auth // Ignored if Isolate is set.
+	Isolate bool
+	Forward Dialer
+}
+
+/*
+A SOCKS5 dialer for a local Tor daemon, with stream isolation.
+*/
+func Tor() *SOCKS5 {
+	return &SOCKS5{Addr:"127.0.0.1:9050", Isolate:true}
+}
+
+func (s *SOCKS5) Dial(network, addr string) (net.Conn, error) {
+	auth := s.Auth
+	if s.Isolate { auth = &proxy.Auth{User:addr, Password:"ampp"} }
+	d,err := proxy.SOCKS5("tcp",s.Addr,auth,Or(s.Forward))
+	if err!=nil { return nil,err }
+	return d.Dial(network,addr)
+}
+
+/*
+Connects through a HTTP proxy using the CONNECT method.
+*/
+type HTTPConnect struct{
+	Addr string
+	User, Password string // Optional, for Basic authentication.
+	Forward Dialer
+}
+
+type bufConn struct{
+	net.Conn
+	r *bufio.Reader
+}
+func (b *bufConn) Read(p []byte) (int, error) { return b.r.Read(p) }
+
+func (h *HTTPConnect) Dial(network, addr string) (net.Conn, error) {
+	conn,err := Or(h.Forward).Dial("tcp",h.Addr)
+	if err!=nil { return nil,err }
+	req := &http.Request{
+		Method: "CONNECT",
+		URL: &url.URL{Opaque:addr},
+		Host: addr,
+		Header: make(http.Header),
+	}
+	if h.User!="" {
+		cred := base64.StdEncoding.EncodeToString([]byte(h.User+":"+h.Password))
+		req.Header.Set("Proxy-Authorization","Basic "+cred)
+	}
+	err = req.Write(conn)
+	if err!=nil { conn.Close(); return nil,err }
+	
+	// The server may speak first (as SMTP and IMAP servers do), so the
+	// buffered reader must be kept.
+	br := bufio.NewReader(conn)
+	resp,err := http.ReadResponse(br,req)
+	if err!=nil { conn.Close(); return nil,err }
+	resp.Body.Close()
+	if resp.StatusCode!=200 {
+		conn.Close()
+		return nil,fmt.Errorf("proxy: CONNECT %s: %s",addr,resp.Status)
+	}
+	return &bufConn{conn,br},nil
+}
@@ -0,0 +1,196 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package dialer
+
+import "golang.org/x/net/proxy"
+import "bufio"
+import "encoding/binary"
+import "fmt"
+import "io"
+import "net"
+import "net/http"
+import "strconv"
+import "sync"
+import "testing"
+
+/*
+A minimal SOCKS5 server (RFC 1928, RFC 1929), that records the credentials
+of every connection.
+*/
+type socksServer struct{
+	l net.Listener
+	lock sync.Mutex
+	creds []string
+}
+
+func newSocksServer(t *testing.T) *socksServer {
+	l,err := net.Listen("tcp","127.0.0.1:0")
+	if err!=nil { t.Fatal(err) }
+	s := &socksServer{l:l}
+	go func() {
+		for {
+			c,err := l.Accept()
+			if err!=nil { return }
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *socksServer) credentials() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil),s.creds...)
+}
+
+func readString(r io.Reader) (string,error) {
+	var n [1]byte
+	_,err := io.ReadFull(r,n[:])
+	if err!=nil { return "",err }
+	b := make([]byte,n[0])
+	_,err = io.ReadFull(r,b)
+	return string(b),err
+}
+
+func (s *socksServer) serve(c net.Conn) {
+	defer c.Close()
+	var hdr [2]byte
+	if _,err := io.ReadFull(c,hdr[:]); err!=nil || hdr[0]!=5 { return }
+	methods := make([]byte,hdr[1])
+	if _,err := io.ReadFull(c,methods); err!=nil { return }
+	auth := false
+	for _,m := range methods {
+		if m==2 { auth = true }
+	}
+	cred := ""
+	if auth {
+		c.Write([]byte{5,2})
+		if _,err := io.ReadFull(c,hdr[:1]); err!=nil || hdr[0]!=1 { return }
+		user,err := readString(c)
+		if err!=nil { return }
+		pass,err := readString(c)
+		if err!=nil { return }
+		cred = user+":"+pass
+		c.Write([]byte{1,0})
+	} else {
+		c.Write([]byte{5,0})
+	}
+	s.lock.Lock()
+	s.creds = append(s.creds,cred)
+	s.lock.Unlock()
+	
+	var req [4]byte
+	if _,err := io.ReadFull(c,req[:]); err!=nil || req[1]!=1 { return }
+	var host string
+	switch req[3] {
+	case 1:
+		var ip [4]byte
+		if _,err := io.ReadFull(c,ip[:]); err!=nil { return }
+		host = net.IP(ip[:]).String()
+	case 3:
+		h,err := readString(c)
+		if err!=nil { return }
+		host = h
+	default:
+		return
+	}
+	var port [2]byte
+	if _,err := io.ReadFull(c,port[:]); err!=nil { return }
+	addr := net.JoinHostPort(host,strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	up,err := net.Dial("tcp",addr)
+	if err!=nil { c.Write([]byte{5,5,0,1,0,0,0,0,0,0}); return }
+	defer up.Close()
+	c.Write([]byte{5,0,0,1,0,0,0,0,0,0})
+	go io.Copy(up,c)
+	io.Copy(c,up)
+}
+
+/*
+A server, that greets first, like SMTP and IMAP servers do.
+*/
+func newGreeter(t *testing.T,greeting string) string {
+	l,err := net.Listen("tcp","127.0.0.1:0")
+	if err!=nil { t.Fatal(err) }
+	go func() {
+		for {
+			c,err := l.Accept()
+			if err!=nil { return }
+			fmt.Fprintf(c,"%s\r\n",greeting)
+			c.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func expectGreeting(t *testing.T,d Dialer,addr,greeting string) {
+	c,err := d.Dial("tcp",addr)
+	if err!=nil { t.Fatal(err) }
+	defer c.Close()
+	line,err := bufio.NewReader(c).ReadString('\n')
+	if err!=nil { t.Fatal(err) }
+	if line!=greeting+"\r\n" { t.Fatalf("got %q",line) }
+}
+
+func TestSOCKS5Isolate(t *testing.T) {
+	s := newSocksServer(t)
+	defer s.l.Close()
+	a := newGreeter(t,"220 a")
+	b := newGreeter(t,"220 b")
+	
+	d := &SOCKS5{Addr:s.l.Addr().String(),Isolate:true,Auth:&proxy.Auth{User:"ignored",Password:"x"}}
+	expectGreeting(t,d,a,"220 a")
+	expectGreeting(t,d,b,"220 b")
+	expectGreeting(t,d,a,"220 a")
+	
+	creds := s.credentials()
+	want := []string{a+":ampp",b+":ampp",a+":ampp"}
+	if fmt.Sprint(creds)!=fmt.Sprint(want) { t.Fatalf("credentials %v, want %v",creds,want) }
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	s := newSocksServer(t)
+	defer s.l.Close()
+	a := newGreeter(t,"* OK")
+	
+	expectGreeting(t,&SOCKS5{Addr:s.l.Addr().String(),Auth:&proxy.Auth{User:"user",Password:"secret"}},a,"* OK")
+	expectGreeting(t,&SOCKS5{Addr:s.l.Addr().String()},a,"* OK")
+	
+	creds := s.credentials()
+	if len(creds)!=2 || creds[0]!="user:secret" || creds[1]!="" { t.Fatalf("credentials %q",creds) }
+}
+
+func TestHTTPConnect(t *testing.T) {
+	a := newGreeter(t,"220 greeting")
+	l,err := net.Listen("tcp","127.0.0.1:0")
+	if err!=nil { t.Fatal(err) }
+	defer l.Close()
+	auth := make(chan string,1)
+	go http.Serve(l,http.HandlerFunc(func(w http.ResponseWriter,r *http.Request) {
+		auth <- r.Header.Get("Proxy-Authorization")
+		up,err := net.Dial("tcp",r.Host)
+		if err!=nil { w.WriteHeader(502); return }
+		defer up.Close()
+		c,_,err := w.(http.Hijacker).Hijack()
+		if err!=nil { return }
+		defer c.Close()
+		io.WriteString(c,"HTTP/1.1 200 Connection established\r\n\r\n")
+		io.Copy(c,up)
+	}))
+	
+	// The greeting may arrive together with the CONNECT response.
+	expectGreeting(t,&HTTPConnect{Addr:l.Addr().String(),User:"u",Password:"p"},a,"220 greeting")
+	if a := <-auth; a!="Basic dTpw" { t.Fatalf("Proxy-Authorization %q",a) }
+}
+
+func TestHasCapability(t *testing.T) {
+	capa := []string{"USER","stls","SASL PLAIN"}
+	for name,want := range map[string]bool{"STLS":true,"sasl":true,"PLAIN":false,"STARTTLS":false} {
+		if HasCapability(capa,name)!=want { t.Errorf("%s: %v",name,!want) }
+	}
+}
@@ -0,0 +1,57 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+// IMAP connections to upstream mailboxes.
+package imapio
+
+import "github.com/emersion/go-imap/client"
+import "github.com/a-mail-group/ampp/dialer"
+import "errors"
+
+var (
+	ENoStartTLS = errors.New("IMAP server does not support STARTTLS")
+)
+
+/*
+Connects to an IMAP server using a pluggable dialer. Implicit TLS uses port 993.
+If Username is not empty, the connection is logged in.
+*/
+type Connector dialer.Connector
+
+/*
+Dials, negotiates TLS and logs in.
+*/
+func (c *Connector) Connect() (cl *client.Client,err error) {
+	return c.ConnectUpdates(nil)
+}
+
+/*
+Like Connect, but sets the Updates channel of the client before the first
+command is sent. Setting it later races with the reader goroutine of the
+client.
+*/
+func (c *Connector) ConnectUpdates(updates chan<- client.Update) (cl *client.Client,err error) {
+	dc := (*dialer.Connector)(c)
+	conn,err := dc.Dial()
+	if err!=nil { return }
+	cl,err = client.New(conn)
+	if err!=nil { conn.Close(); return }
+	cl.Updates = updates
+	if dc.NeedStartTLS() {
+		ok,e := cl.SupportStartTLS()
+		if e!=nil { err = e; cl.Logout(); cl = nil; return }
+		if !ok { err = ENoStartTLS; cl.Logout(); cl = nil; return }
+		err = cl.StartTLS(dc.TLSConfig())
+		if err!=nil { cl.Logout(); cl = nil; return }
+	}
+	if c.Username!="" {
+		err = cl.Login(c.Username,c.Password)
+		if err!=nil { cl.Logout(); cl = nil; return }
+	}
+	return
+}
@@ -0,0 +1,163 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package imapio
+
+import "github.com/emersion/go-imap/client"
+import "github.com/a-mail-group/ampp/crypto/boxpgp"
+import "github.com/a-mail-group/ampp/qmodel"
+import "github.com/a-mail-group/ampp/queue"
+import message "github.com/emersion/go-message"
+import "golang.org/x/crypto/openpgp"
+import "bytes"
+import "io"
+import "strings"
+import "time"
+
+/*
+An upstream mailbox, that receives mail encrypted to Keys.
+*/
+type Mailbox struct{
+	Connector *Connector
+	Mailbox string // Empty means INBOX.
+	
+	// The public keys of the user.
+	Keys []*openpgp.Entity
+	
+	// If not nil, a blind index of the envelope is added with this key (see
+	// boxpgp.IndexHeader).
+	IndexKey []byte
+}
+
+func (m *Mailbox) name() string {
+	if m.Mailbox=="" { return "INBOX" }
+	return m.Mailbox
+}
+
+/*
+Delivers the messages in a queue (for example, filled by smtpio.Input) into
+upstream IMAP mailboxes. Each message is encrypted with boxpgp.EncryptEMail
+before it is appended, so the upstream provider only stores ciphertext.
+*/
+type Output struct{
+	Q *queue.Queue
+	N string
+	
+	// Mailboxes by recipient address. The keys must be lower case.
+	Users map[string]*Mailbox
+	
+	// If not empty, messages for unknown recipients and messages that can
+	// not be encrypted are moved into this queue. Otherwise they are dropped.
+	Rejected string
+}
+
+/*
+Encrypts a message for m. Messages that are already encrypted to m (see
+boxpgp.IsEnclosed) are stored as they are.
+*/
+func (m *Mailbox) seal(raw []byte) ([]byte,error) {
+	msg,err := message.Read(bytes.NewReader(raw))
+	if err!=nil { return nil,err }
+	if boxpgp.IsEnclosed(msg,openpgp.EntityList(m.Keys)) { return raw,nil }
+	hdr := make(message.Header)
+	if m.IndexKey!=nil { boxpgp.IndexHeader(hdr,msg.Header,m.IndexKey) }
+	e,err := boxpgp.EncryptEMail(raw,hdr,m.Keys)
+	if err!=nil { return nil,err }
+	buf := new(bytes.Buffer)
+	err = e.WriteTo(buf)
+	if err!=nil { return nil,err }
+	return buf.Bytes(),nil
+}
+
+// Connections by Connector. A nil entry marks a failed connection.
+type connections map[*Connector]*client.Client
+
+func (cs connections) get(c *Connector) *client.Client {
+	if conn,ok := cs[c]; ok { return conn }
+	conn,err := c.Connect()
+	if err!=nil { conn = nil }
+	cs[c] = conn
+	return conn
+}
+
+func (cs connections) logout() {
+	for _,conn := range cs {
+		if conn!=nil { conn.Logout() }
+	}
+}
+
+/*
+Delivers all queued messages. Recipients whose mailbox could not be reached
+are retried on the next call. Errors of the queue are returned after the
+transaction has been committed, so that the messages are not appended twice.
+*/
+func (o *Output) Process() error {
+	conns := make(connections)
+	defer conns.logout()
+	var qerr error
+	err := o.Q.Process(func(tx *queue.Tx) error {
+		f := tx.Fetch(o.N)
+		keys := make([][]byte,0,1024)
+		var retries []*qmodel.Message
+		for {
+			k,m,e := f.Next()
+			if e==io.EOF { break }
+			if e!=nil { keys = append(keys,k); continue } // XXX ignores broken messages.
+			var retry,rejected *qmodel.Message
+			done := make(map[*Mailbox]bool)
+			for _,to := range m.To {
+				mb := o.Users[strings.ToLower(to)]
+				if mb!=nil && done[mb] { continue }
+				var sealed []byte
+				if mb!=nil { sealed,e = mb.seal(m.Body) }
+				if mb==nil || e!=nil {
+					if rejected==nil { rejected = &qmodel.Message{From:m.From,Body:m.Body} }
+					rejected.To = append(rejected.To,to)
+					continue
+				}
+				conn := conns.get(mb.Connector)
+				if conn!=nil {
+					e = conn.Append(mb.name(),nil,time.Now(),bytes.NewBuffer(sealed))
+					if e!=nil { conns[mb.Connector] = nil; conn.Logout() }
+				}
+				if conn==nil || e!=nil {
+					// Network errors and temporary failures.
+					if retry==nil { retry = &qmodel.Message{From:m.From,Body:m.Body} }
+					retry.To = append(retry.To,to)
+					continue
+				}
+				done[mb] = true
+			}
+			if rejected!=nil && o.Rejected!="" {
+				e = tx.EnqueueMessage(o.Rejected,rejected)
+				if e!=nil {
+					// The rejected recipients are retried, so that they are not lost.
+					if qerr==nil { qerr = e }
+					if retry==nil { retry = &qmodel.Message{From:m.From,Body:m.Body} }
+					retry.To = append(retry.To,rejected.To...)
+				}
+			}
+			if retry!=nil { retries = append(retries,retry) }
+			keys = append(keys,k)
+			if len(keys)>=1024 {
+				e = tx.RemoveAll(o.N,keys)
+				if e!=nil && qerr==nil { qerr = e }
+				keys = keys[:0]
+			}
+		}
+		e := tx.RemoveAll(o.N,keys)
+		if e!=nil && qerr==nil { qerr = e }
+		for _,m := range retries {
+			e = tx.EnqueueMessage(o.N,m)
+			if e!=nil && qerr==nil { qerr = e }
+		}
+		return nil
+	})
+	if err==nil { err = qerr }
+	return err
+}
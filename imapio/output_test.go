@@ -0,0 +1,114 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package imapio
+
+import "github.com/a-mail-group/ampp/crypto/boxpgp"
+import "github.com/a-mail-group/ampp/qmodel"
+import "github.com/a-mail-group/ampp/queue"
+import "github.com/emersion/go-imap/backend/memory"
+import "github.com/emersion/go-imap/server"
+import message "github.com/emersion/go-message"
+import "golang.org/x/crypto/openpgp"
+import "bytes"
+import "io/ioutil"
+import "net"
+import "os"
+import "path/filepath"
+import "testing"
+
+func testKey(t *testing.T,email string) *openpgp.Entity {
+	e,err := openpgp.NewEntity("test","",email,nil)
+	if err!=nil { t.Fatal(err) }
+	for _,id := range e.Identities {
+		id.SelfSignature.PreferredHash = []uint8{8} // SHA-256
+		err = id.SelfSignature.SignUserId(id.UserId.Id,e.PrimaryKey,e.PrivateKey,nil)
+		if err!=nil { t.Fatal(err) }
+	}
+	return e
+}
+
+func TestOutput(t *testing.T) {
+	dir,err := ioutil.TempDir("","imap")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	q,err := queue.Open(filepath.Join(dir,"queue.db"))
+	if err!=nil { t.Fatal(err) }
+	defer q.Close()
+	count := func(name string) (n int) {
+		err := q.Process(func(tx *queue.Tx) error {
+			f := tx.Fetch(name)
+			for {
+				_,_,err := f.Next()
+				if err!=nil { return nil }
+				n++
+			}
+		})
+		if err!=nil { t.Fatal(err) }
+		return
+	}
+	enqueue := func(to string,body []byte) {
+		err := q.EnqueueMessage("in",&qmodel.Message{From:"alice@example.org",To:[]string{to},Body:body})
+		if err!=nil { t.Fatal(err) }
+	}
+
+	// The memory backend starts with a message in the INBOX.
+	b := memory.New()
+	s := server.New(b)
+	s.AllowInsecureAuth = true
+	l,err := net.Listen("tcp","127.0.0.1:0")
+	if err!=nil { t.Fatal(err) }
+	defer l.Close()
+	go s.Serve(l)
+	u,err := b.Login(nil,"username","password")
+	if err!=nil { t.Fatal(err) }
+	mbox,err := u.GetMailbox("INBOX")
+	if err!=nil { t.Fatal(err) }
+	inbox := mbox.(*memory.Mailbox)
+
+	bob := testKey(t,"bob@example.org")
+	public := &openpgp.Entity{PrimaryKey:bob.PrimaryKey,Identities:bob.Identities,Subkeys:bob.Subkeys}
+	mb := &Mailbox{Connector:&Connector{Addr:l.Addr().String(),NoTLS:true,Username:"username",Password:"password"},Keys:[]*openpgp.Entity{public}}
+	o := &Output{Q:q,N:"in",Users:map[string]*Mailbox{"bob@example.org":mb},Rejected:"rejected"}
+
+	plain := []byte("From: alice@example.org\r\nTo: bob@example.org\r\nSubject: hello\r\n\r\nbody\r\n")
+	enc,err := boxpgp.EncryptEMail(plain,nil,[]*openpgp.Entity{bob})
+	if err!=nil { t.Fatal(err) }
+	buf := new(bytes.Buffer)
+	err = enc.WriteTo(buf)
+	if err!=nil { t.Fatal(err) }
+	sealed := buf.Bytes()
+	fake := append([]byte("X-Encrypted: ENCLOSED-OPGP\r\n"),plain...)
+	enqueue("Bob@example.org",plain)
+	enqueue("bob@example.org",sealed)
+	enqueue("bob@example.org",fake)
+	enqueue("carol@example.org",plain)
+	err = o.Process()
+	if err!=nil { t.Fatal(err) }
+	if n := count("in"); n!=0 { t.Fatalf("%d messages left",n) }
+	if n := count("rejected"); n!=1 { t.Fatalf("%d messages rejected",n) }
+	if len(inbox.Messages)!=4 { t.Fatalf("%d messages stored",len(inbox.Messages)) }
+
+	// Messages that are already sealed are stored as they are, the others,
+	// including the one with only the header, are sealed.
+	if !bytes.Equal(inbox.Messages[2].Body,sealed) { t.Error("sealed message changed") }
+	for i,want := range map[int][]byte{1:plain,3:fake} {
+		msg,err := message.Read(bytes.NewReader(inbox.Messages[i].Body))
+		if err!=nil { t.Fatal(err) }
+		raw,err := boxpgp.DecryptEMailRaw(msg,openpgp.EntityList{bob})
+		if err!=nil { t.Fatal(i,err) }
+		if !bytes.Equal(raw,want) { t.Errorf("message %d: %q",i,raw) }
+	}
+
+	// Recipients, whose mailbox can not be reached, are retried.
+	l.Close()
+	enqueue("bob@example.org",plain)
+	err = o.Process()
+	if err!=nil { t.Fatal(err) }
+	if n := count("in"); n!=1 { t.Fatalf("%d messages left",n) }
+}
@@ -0,0 +1,54 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package imapio
+
+import "github.com/emersion/go-imap"
+import "github.com/emersion/go-imap/client"
+
+func uidExpunge(c *client.Client, uids *imap.SeqSet) error {
+	cmd := &imap.Command{
+		Name: "UID",
+		Arguments: []interface{}{imap.RawString("EXPUNGE"),uids},
+	}
+	status,err := c.Execute(cmd,nil)
+	if err!=nil { return err }
+	return status.Err()
+}
+
+/*
+Flags the messages with the given UIDs as \Deleted and expunges them using
+UID EXPUNGE (RFC 4315), if the server supports UIDPLUS. Otherwise the messages
+are only flagged, because EXPUNGE would also remove any other message flagged
+as \Deleted by concurrent clients.
+*/
+func DeleteUids(c *client.Client, uids *imap.SeqSet) (expunged bool,err error) {
+	if uids.Empty() { return }
+	err = c.UidStore(uids,imap.FormatFlagsOp(imap.AddFlags, true),[]interface{}{imap.DeletedFlag},nil)
+	if err!=nil { return }
+	ok,err := c.Support("UIDPLUS")
+	if err!=nil || !ok { return }
+	err = uidExpunge(c,uids)
+	expunged = err==nil
+	return
+}
+
+/*
+Moves the messages with the given UIDs into another mailbox. It uses MOVE
+(RFC 6851) if supported, otherwise UID COPY followed by DeleteUids().
+*/
+func MoveUids(c *client.Client, uids *imap.SeqSet, dest string) error {
+	if uids.Empty() { return nil }
+	ok,err := c.Support("MOVE")
+	if err!=nil { return err }
+	if ok { return c.UidMove(uids,dest) }
+	err = c.UidCopy(uids,dest)
+	if err!=nil { return err }
+	_,err = DeleteUids(c,uids)
+	return err
+}
@@ -0,0 +1,197 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+/*
+An IMAP server that fronts an upstream IMAP account and keeps the mail
+stored there encrypted with boxpgp. Messages are encrypted on APPEND and
+decrypted on FETCH, so the upstream provider only sees ciphertext.
+*/
+package imapproxy
+
+import "github.com/a-mail-group/ampp/imapio"
+import "github.com/a-mail-group/ampp/crypto/boxpgp"
+import "github.com/emersion/go-imap"
+import "github.com/emersion/go-imap/backend"
+import "github.com/emersion/go-imap/client"
+import message "github.com/emersion/go-message"
+import "golang.org/x/crypto/openpgp"
+import "bytes"
+import "errors"
+import "sync"
+
+var (
+	ENoPrivateKey = errors.New("Key ring has no private key")
+)
+
+type Backend struct{
+	// The upstream server. Username and Password are taken from LOGIN.
+	Upstream imapio.Connector
+	
+	// Returns a fresh copy of the key ring of a user. The private keys are
+	// decrypted in place with the LOGIN password.
+	Keys func(username string) (openpgp.EntityList,error)
+	
+	// If set, plaintext messages (delivered by the upstream provider) are
+	// replaced by encrypted copies when a mailbox is opened. Without UIDPLUS,
+	// the originals are only flagged as \Deleted.
+	SealIncoming bool
+	
+	// If not nil, returns the key of the blind index of a user (see
+	// boxpgp.IndexHeader). Sealed messages are indexed, and searches for whole
+	// addresses, domains and Message-Ids are evaluated upstream. Messages
+	// without index, and all other searches, are evaluated by the proxy.
+	IndexKey func(username string) []byte
+}
+
+var _ backend.Backend = (*Backend)(nil)
+
+/*
+Decrypts the private keys of a key ring.
+*/
+func unlockKeys(keys openpgp.EntityList, passphrase []byte) error {
+	found := false
+	for _,e := range keys {
+		if e.PrivateKey==nil { continue }
+		found = true
+		if e.PrivateKey.Encrypted {
+			err := e.PrivateKey.Decrypt(passphrase)
+			if err!=nil { return err }
+		}
+		for _,sk := range e.Subkeys {
+			if sk.PrivateKey==nil || !sk.PrivateKey.Encrypted { continue }
+			err := sk.PrivateKey.Decrypt(passphrase)
+			if err!=nil { return err }
+		}
+	}
+	if !found { return ENoPrivateKey }
+	return nil
+}
+
+func (b *Backend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	keys,err := b.Keys(username)
+	if err!=nil { return nil,backend.ErrInvalidCredentials }
+	err = unlockKeys(keys,[]byte(password))
+	if err!=nil { return nil,backend.ErrInvalidCredentials }
+	conn := b.Upstream
+	conn.Username,conn.Password = username,password
+	c,err := conn.Connect()
+	if err!=nil { return nil,err }
+	u := &user{b:b,name:username,keys:keys,c:c}
+	if b.IndexKey!=nil { u.index = b.IndexKey(username) }
+	return u,nil
+}
+
+type user struct{
+	b *Backend
+	name string
+	keys openpgp.EntityList
+	index []byte
+	
+	// Guards the upstream connection, which has one selected mailbox.
+	lock sync.Mutex
+	c *client.Client
+}
+
+var _ backend.User = (*user)(nil)
+
+func (u *user) Username() string { return u.name }
+
+/*
+Encrypts a message to the user.
+*/
+func (u *user) seal(raw []byte) ([]byte,error) {
+	var hdr message.Header
+	if u.index!=nil {
+		msg,err := message.Read(bytes.NewReader(raw))
+		if err!=nil { return nil,err }
+		hdr = make(message.Header)
+		boxpgp.IndexHeader(hdr,msg.Header,u.index)
+	}
+	e,err := boxpgp.EncryptEMail(raw,hdr,u.keys)
+	if err!=nil { return nil,err }
+	buf := new(bytes.Buffer)
+	err = e.WriteTo(buf)
+	if err!=nil { return nil,err }
+	return buf.Bytes(),nil
+}
+
+/*
+Decrypts a message. Messages that are not encrypted are returned as they are.
+An encrypted message, that can not be decrypted or whose envelope does not
+match (boxpgp.EEnvelopeMismatch), is an error.
+*/
+func (u *user) open(raw []byte) ([]byte,error) {
+	e,err := message.Read(bytes.NewReader(raw))
+	if err!=nil { return raw,nil }
+	plain,err := boxpgp.DecryptEMailRaw(e,u.keys)
+	if err==boxpgp.ENotEnclosed { return raw,nil }
+	return plain,err
+}
+
+func (u *user) list(name string, subscribed bool) (infos []*imap.MailboxInfo,err error) {
+	ch := make(chan *imap.MailboxInfo,16)
+	done := make(chan error,1)
+	go func() {
+		if subscribed {
+			done <- u.c.Lsub("",name,ch)
+		} else {
+			done <- u.c.List("",name,ch)
+		}
+	}()
+	for info := range ch { infos = append(infos,info) }
+	err = <-done
+	return
+}
+
+func (u *user) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	infos,err := u.list("*",subscribed)
+	if err!=nil { return nil,err }
+	mboxes := make([]backend.Mailbox,len(infos))
+	for i,info := range infos { mboxes[i] = &mailbox{u,info} }
+	return mboxes,nil
+}
+
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	infos,err := u.list(name,false)
+	if err!=nil { return nil,err }
+	if len(infos)==0 { return nil,backend.ErrNoSuchMailbox }
+	m := &mailbox{u,infos[0]}
+	if u.b.SealIncoming {
+		err = m.sealIncoming()
+		if err!=nil { return nil,err }
+	}
+	return m,nil
+}
+
+func (u *user) CreateMailbox(name string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.c.Create(name)
+}
+
+func (u *user) DeleteMailbox(name string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.c.Delete(name)
+}
+
+func (u *user) RenameMailbox(existingName, newName string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.c.Rename(existingName,newName)
+}
+
+func (u *user) Logout() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.c.Logout()
+}
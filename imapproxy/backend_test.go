@@ -0,0 +1,186 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package imapproxy
+
+import "github.com/a-mail-group/ampp/imapio"
+import "github.com/a-mail-group/ampp/crypto/boxpgp"
+import "github.com/emersion/go-imap"
+import "github.com/emersion/go-imap/backend"
+import "github.com/emersion/go-imap/backend/memory"
+import "github.com/emersion/go-imap/server"
+import message "github.com/emersion/go-message"
+import "golang.org/x/crypto/openpgp"
+import "bytes"
+import "net"
+import "testing"
+import "time"
+
+const testPlain = "From: alice@example.org\r\nTo: bob@example.org\r\nSubject: hello\r\n\r\nsecret body\r\n"
+
+var testEntity *openpgp.Entity
+
+/*
+Returns the key ring of the proxy user, generated once per test binary.
+*/
+func testKeys(t *testing.T) openpgp.EntityList {
+	if testEntity==nil {
+		e,err := openpgp.NewEntity("test","","bob@example.org",nil)
+		if err!=nil { t.Fatal(err) }
+		for _,id := range e.Identities {
+			id.SelfSignature.PreferredHash = []uint8{8} // SHA-256
+			err = id.SelfSignature.SignUserId(id.UserId.Id,e.PrimaryKey,e.PrivateKey,nil)
+			if err!=nil { t.Fatal(err) }
+		}
+		testEntity = e
+	}
+	return openpgp.EntityList{testEntity}
+}
+
+func serialize(t *testing.T,e *message.Entity) []byte {
+	buf := new(bytes.Buffer)
+	err := e.WriteTo(buf)
+	if err!=nil { t.Fatal(err) }
+	return buf.Bytes()
+}
+
+/*
+Starts an upstream server with the memory backend of go-imap and returns its
+INBOX and a proxy in front of it. The INBOX starts with a plaintext message
+(UID 6).
+*/
+func newUpstream(t *testing.T) (*memory.Mailbox,*Backend,net.Listener) {
+	b := memory.New()
+	s := server.New(b)
+	s.AllowInsecureAuth = true
+	l,err := net.Listen("tcp","127.0.0.1:0")
+	if err!=nil { t.Fatal(err) }
+	go s.Serve(l)
+	u,err := b.Login(nil,"username","password")
+	if err!=nil { t.Fatal(err) }
+	m,err := u.GetMailbox("INBOX")
+	if err!=nil { t.Fatal(err) }
+	p := &Backend{
+		Upstream: imapio.Connector{Addr:l.Addr().String(),NoTLS:true},
+		Keys: func(string) (openpgp.EntityList,error) { return testKeys(t),nil },
+	}
+	return m.(*memory.Mailbox),p,l
+}
+
+func store(t *testing.T,m *memory.Mailbox,data []byte) {
+	err := m.CreateMessage(nil,time.Now(),bytes.NewReader(data))
+	if err!=nil { t.Fatal(err) }
+}
+
+func login(t *testing.T,p *Backend) (backend.User,backend.Mailbox) {
+	u,err := p.Login(nil,"username","password")
+	if err!=nil { t.Fatal(err) }
+	m,err := u.GetMailbox("INBOX")
+	if err!=nil { u.Logout(); t.Fatal(err) }
+	return u,m
+}
+
+/*
+Fetches the size and the content of a message.
+*/
+func list(m backend.Mailbox,uid uint32) ([]*imap.Message,error) {
+	set := new(imap.SeqSet)
+	set.AddNum(uid)
+	ch := make(chan *imap.Message,16)
+	err := m.ListMessages(true,set,[]imap.FetchItem{imap.FetchUid,imap.FetchRFC822Size,"BODY.PEEK[]"},ch)
+	var msgs []*imap.Message
+	for msg := range ch { msgs = append(msgs,msg) }
+	return msgs,err
+}
+
+func content(msg *imap.Message) string {
+	for _,l := range msg.Body { return l.(*bytes.Buffer).String() }
+	return ""
+}
+
+func TestListMessages(t *testing.T) {
+	inbox,p,l := newUpstream(t)
+	defer l.Close()
+	keys := testKeys(t)
+	
+	enc,err := boxpgp.EncryptEMail([]byte(testPlain),nil,keys)
+	if err!=nil { t.Fatal(err) }
+	sealed := serialize(t,enc)
+	store(t,inbox,sealed)
+	
+	// The encrypted envelope claims another sender than the enclosed message.
+	enc,err = boxpgp.EncryptEMail([]byte(testPlain),nil,keys)
+	if err!=nil { t.Fatal(err) }
+	other := make(message.Header)
+	other.Set("From","mallory@example.org")
+	other.Set("Subject","hello")
+	err = boxpgp.EncodeHeader(enc.Header,other,keys)
+	if err!=nil { t.Fatal(err) }
+	store(t,inbox,serialize(t,enc))
+	
+	u,m := login(t,p)
+	defer u.Logout()
+	
+	// Plaintext messages are passed through.
+	msgs,err := list(m,6)
+	if err!=nil || len(msgs)!=1 { t.Fatal(msgs,err) }
+	plain := inbox.Messages[0].Body
+	if content(msgs[0])!=string(plain) { t.Fatalf("plaintext body %q",content(msgs[0])) }
+	if msgs[0].Size!=uint32(len(plain)) { t.Fatal("plaintext size",msgs[0].Size) }
+	
+	// Sealed messages are decrypted; the size is the one of the stored message.
+	msgs,err = list(m,7)
+	if err!=nil || len(msgs)!=1 { t.Fatal(msgs,err) }
+	if content(msgs[0])!=testPlain { t.Fatalf("decrypted body %q",content(msgs[0])) }
+	if msgs[0].Size!=uint32(len(sealed)) { t.Fatalf("size %d, want %d",msgs[0].Size,len(sealed)) }
+	
+	msgs,err = list(m,8)
+	if err!=boxpgp.EEnvelopeMismatch || len(msgs)!=0 { t.Fatal(msgs,err) }
+}
+
+func TestSealIncoming(t *testing.T) {
+	inbox,p,l := newUpstream(t)
+	defer l.Close()
+	p.SealIncoming = true
+	keys := testKeys(t)
+	
+	enc,err := boxpgp.EncryptEMail([]byte(testPlain),nil,keys)
+	if err!=nil { t.Fatal(err) }
+	sealed := serialize(t,enc)
+	store(t,inbox,sealed)
+	fake := "X-Encrypted: ENCLOSED-OPGP\r\n"+testPlain
+	store(t,inbox,[]byte(fake))
+	seed := string(inbox.Messages[0].Body)
+	
+	u,m := login(t,p)
+	defer u.Logout()
+	
+	// The plaintext message (UID 6) and the one with only the header (UID 8)
+	// are replaced; the sealed message (UID 7) is kept.
+	if len(inbox.Messages)!=5 { t.Fatalf("%d messages upstream",len(inbox.Messages)) }
+	for i,deleted := range []bool{true,false,true,false,false} {
+		msg := inbox.Messages[i]
+		if hasFlag(msg.Flags,imap.DeletedFlag)!=deleted { t.Errorf("UID %d: flags %v",msg.Uid,msg.Flags) }
+		if deleted { continue }
+		e,err := message.Read(bytes.NewReader(msg.Body))
+		if err!=nil || !boxpgp.IsEnclosed(e,keys) { t.Errorf("UID %d is not sealed",msg.Uid) }
+	}
+	if !bytes.Equal(inbox.Messages[1].Body,sealed) { t.Error("sealed message changed") }
+	for uid,want := range map[uint32]string{9:seed,10:fake} {
+		msgs,err := list(m,uid)
+		if err!=nil || len(msgs)!=1 { t.Fatal(msgs,err) }
+		if content(msgs[0])!=want { t.Errorf("UID %d: %q",uid,content(msgs[0])) }
+	}
+}
+
+func hasFlag(flags []string,flag string) bool {
+	for _,f := range flags {
+		if f==flag { return true }
+	}
+	return false
+}
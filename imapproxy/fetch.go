@@ -0,0 +1,265 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package imapproxy
+
+import "github.com/emersion/go-imap"
+import "net/textproto"
+import "net/mail"
+import "bufio"
+import "bytes"
+import "mime"
+import "strings"
+
+/*
+Multipart and message/rfc822 entities nested deeper are treated as opaque.
+*/
+const maxNesting = 32
+
+/*
+A MIME entity of a decrypted message. header and body are slices of raw; the
+empty line belongs to the header.
+*/
+type part struct{
+	raw, header, body []byte
+	h textproto.MIMEHeader
+	
+	// The lower-case media type and its parameters.
+	mediaType string
+	params map[string]string
+	
+	parts []*part // multipart/*
+	message *part // message/rfc822
+}
+
+/*
+Splits an entity into its header and its body.
+*/
+func splitEntity(raw []byte) (header, body []byte) {
+	for pos := 0; pos<len(raw); {
+		end := bytes.IndexByte(raw[pos:],'\n')
+		if end<0 { break }
+		end += pos+1
+		if len(bytes.TrimRight(raw[pos:end],"\r\n"))==0 { return raw[:end],raw[end:] }
+		pos = end
+	}
+	return raw,nil
+}
+
+func trimLineBreak(b []byte) []byte {
+	if bytes.HasSuffix(b,[]byte("\r\n")) { return b[:len(b)-2] }
+	if bytes.HasSuffix(b,[]byte("\n")) { return b[:len(b)-1] }
+	return b
+}
+
+/*
+Splits the body of a multipart entity into its parts (RFC 2046, 5.1.1). The
+line break before a delimiter belongs to the delimiter. The preamble and the
+epilogue are dropped.
+*/
+func splitMultipart(body []byte, boundary string) (parts [][]byte) {
+	if boundary=="" { return }
+	delim := []byte("--"+boundary)
+	start := -1
+	for pos := 0; pos<len(body); {
+		end := bytes.IndexByte(body[pos:],'\n')
+		if end<0 { end = len(body) } else { end += pos+1 }
+		line := body[pos:end]
+		if bytes.HasPrefix(line,delim) {
+			rest := bytes.TrimRight(line[len(delim):]," \t\r\n")
+			closing := string(rest)=="--"
+			if len(rest)==0 || closing {
+				if start>=0 { parts = append(parts,trimLineBreak(body[start:pos])) }
+				if closing { return }
+				start = end
+			}
+		}
+		pos = end
+	}
+	if start>=0 { parts = append(parts,body[start:]) }
+	return
+}
+
+/*
+Parses a MIME entity. defaultType is used if it has no valid Content-Type.
+*/
+func parsePart(raw []byte, defaultType string, depth int) *part {
+	p := &part{raw:raw}
+	p.header,p.body = splitEntity(raw)
+	p.h,_ = textproto.NewReader(bufio.NewReader(bytes.NewReader(p.header))).ReadMIMEHeader()
+	var err error
+	p.mediaType,p.params,err = mime.ParseMediaType(p.h.Get("Content-Type"))
+	if err==mime.ErrInvalidMediaParameter { err = nil }
+	if err!=nil || strings.IndexByte(p.mediaType,'/')<1 {
+		p.mediaType,p.params = defaultType,nil
+		if defaultType=="text/plain" { p.params = map[string]string{"charset":"us-ascii"} }
+	}
+	if depth>=maxNesting { return p }
+	switch {
+	case strings.HasPrefix(p.mediaType,"multipart/"):
+		sub := "text/plain"
+		if p.mediaType=="multipart/digest" { sub = "message/rfc822" }
+		for _,raw := range splitMultipart(p.body,p.params["boundary"]) {
+			p.parts = append(p.parts,parsePart(raw,sub,depth+1))
+		}
+		// A multipart without parts can not be described in BODYSTRUCTURE.
+		if len(p.parts)==0 { p.mediaType,p.params = "application/octet-stream",nil }
+	case p.mediaType=="message/rfc822":
+		p.message = parsePart(p.body,"text/plain",depth+1)
+	}
+	return p
+}
+
+/*
+Parses a decrypted message.
+*/
+func parseMessage(raw []byte) *part { return parsePart(raw,"text/plain",0) }
+
+func addressList(h textproto.MIMEHeader, name string) (list []*imap.Address) {
+	v := h.Get(name)
+	if v=="" { return }
+	addrs,err := mail.ParseAddressList(v)
+	if err!=nil { return }
+	for _,a := range addrs {
+		ia := &imap.Address{PersonalName:a.Name,MailboxName:a.Address}
+		if i := strings.LastIndexByte(a.Address,'@'); i>=0 { ia.MailboxName,ia.HostName = a.Address[:i],a.Address[i+1:] }
+		list = append(list,ia)
+	}
+	return
+}
+
+/*
+Returns the envelope of a message (RFC 3501, 7.4.2).
+*/
+func envelope(h textproto.MIMEHeader) *imap.Envelope {
+	env := &imap.Envelope{
+		Subject: h.Get("Subject"),
+		From: addressList(h,"From"),
+		Sender: addressList(h,"Sender"),
+		ReplyTo: addressList(h,"Reply-To"),
+		To: addressList(h,"To"),
+		Cc: addressList(h,"Cc"),
+		Bcc: addressList(h,"Bcc"),
+		InReplyTo: h.Get("In-Reply-To"),
+		MessageId: h.Get("Message-Id"),
+	}
+	env.Date,_ = mail.ParseDate(h.Get("Date"))
+	if len(env.Sender)==0 { env.Sender = env.From }
+	if len(env.ReplyTo)==0 { env.ReplyTo = env.From }
+	return env
+}
+
+func countLines(b []byte) uint32 {
+	n := bytes.Count(b,[]byte("\n"))
+	if len(b)>0 && b[len(b)-1]!='\n' { n++ }
+	return uint32(n)
+}
+
+/*
+Returns the BODY (extended==false) or BODYSTRUCTURE of the entity.
+*/
+func (p *part) bodyStructure(extended bool) *imap.BodyStructure {
+	i := strings.IndexByte(p.mediaType,'/')
+	bs := &imap.BodyStructure{
+		MIMEType: p.mediaType[:i],
+		MIMESubType: p.mediaType[i+1:],
+		Params: p.params,
+		Extended: extended,
+	}
+	if extended {
+		bs.Disposition,bs.DispositionParams,_ = mime.ParseMediaType(p.h.Get("Content-Disposition"))
+		for _,l := range strings.Split(p.h.Get("Content-Language"),",") {
+			if l = strings.TrimSpace(l); l!="" { bs.Language = append(bs.Language,l) }
+		}
+		if l := p.h.Get("Content-Location"); l!="" { bs.Location = []string{l} }
+	}
+	if len(p.parts)!=0 {
+		for _,c := range p.parts { bs.Parts = append(bs.Parts,c.bodyStructure(extended)) }
+		return bs
+	}
+	bs.Id = p.h.Get("Content-Id")
+	bs.Description = p.h.Get("Content-Description")
+	bs.Encoding = strings.ToLower(strings.TrimSpace(p.h.Get("Content-Transfer-Encoding")))
+	if bs.Encoding=="" { bs.Encoding = "7bit" }
+	bs.Size = uint32(len(p.body))
+	if extended { bs.MD5 = p.h.Get("Content-Md5") }
+	switch {
+	case p.message!=nil:
+		bs.Envelope = envelope(p.message.h)
+		bs.BodyStructure = p.message.bodyStructure(extended)
+		bs.Lines = countLines(p.body)
+	case bs.MIMEType=="text":
+		bs.Lines = countLines(p.body)
+	}
+	return bs
+}
+
+/*
+Returns the n-th part. A non-multipart entity is its own part 1.
+*/
+func (p *part) child(n int) *part {
+	if len(p.parts)==0 {
+		if n==1 { return p }
+		return nil
+	}
+	if n<1 || n>len(p.parts) { return nil }
+	return p.parts[n-1]
+}
+
+/*
+Returns the header fields listed in fields (or the others, if not is set),
+followed by the empty line.
+*/
+func filterHeader(header []byte, fields []string, not bool) []byte {
+	names := make(map[string]bool)
+	for _,f := range fields { names[textproto.CanonicalMIMEHeaderKey(f)] = true }
+	buf := new(bytes.Buffer)
+	keep := false
+	for _,line := range bytes.SplitAfter(header,[]byte("\n")) {
+		if len(bytes.TrimRight(line,"\r\n"))==0 { break }
+		if line[0]!=' ' && line[0]!='\t' {
+			name := line
+			if i := bytes.IndexByte(line,':'); i>=0 { name = line[:i] }
+			keep = names[textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(name)))]!=not
+		}
+		if keep { buf.Write(line) }
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+/*
+Returns the content of a body section (RFC 3501, 6.4.5). A part that does
+not exist is empty.
+*/
+func (p *part) section(s *imap.BodySectionName) []byte {
+	target := p
+	for i,n := range s.Path {
+		// The parts of a message/rfc822 part are those of the enclosed message.
+		if i>0 && target.message!=nil { target = target.message }
+		target = target.child(n)
+		if target==nil { return nil }
+	}
+	var b []byte
+	switch s.Specifier {
+	case imap.EntireSpecifier:
+		b = target.raw
+		if len(s.Path)!=0 { b = target.body }
+	case imap.MIMESpecifier:
+		if len(s.Path)!=0 { b = target.header }
+	case imap.HeaderSpecifier,imap.TextSpecifier:
+		if len(s.Path)!=0 { target = target.message }
+		switch {
+		case target==nil:
+		case s.Specifier==imap.TextSpecifier: b = target.body
+		case len(s.Fields)!=0: b = filterHeader(target.header,s.Fields,s.NotFields)
+		default: b = target.header
+		}
+	}
+	return s.ExtractPartial(b)
+}
@@ -0,0 +1,92 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package imapproxy
+
+import "github.com/emersion/go-imap"
+import "strings"
+import "testing"
+
+var testMessage = strings.Replace(`From: Alice <alice@example.org>
+To: bob@example.org, Carol <carol@example.net>
+Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=
+Date: Mon, 1 Jan 2018 12:00:00 +0100
+Message-Id: <1@example.org>
+Mime-Version: 1.0
+Content-Type: multipart/mixed; boundary="b1"
+
+preamble
+--b1
+Content-Type: text/plain; charset=utf-8
+
+first
+part
+--b1
+Content-Type: message/rfc822
+Content-Disposition: attachment; filename="fwd.eml"
+
+From: dave@example.com
+Subject: forwarded
+
+inner body
+--b1--
+epilogue
+`,"\n","\r\n",-1)
+
+func section(t *testing.T,p *part,name string) string {
+	s,err := imap.ParseBodySectionName(imap.FetchItem(name))
+	if err!=nil { t.Fatal(name,err) }
+	return string(p.section(s))
+}
+
+func TestEnvelope(t *testing.T) {
+	env := envelope(parseMessage([]byte(testMessage)).h)
+	if env.Subject!="=?utf-8?q?Gr=C3=BC=C3=9Fe?=" || env.MessageId!="<1@example.org>" { t.Fatalf("%+v",env) }
+	if env.Date.Unix()!=1514804400 { t.Fatal("date",env.Date) }
+	if len(env.From)!=1 || env.From[0].PersonalName!="Alice" || env.From[0].MailboxName!="alice" || env.From[0].HostName!="example.org" { t.Fatalf("From %+v",env.From) }
+	if len(env.Sender)!=1 || len(env.ReplyTo)!=1 { t.Fatal("Sender and Reply-To default to From") }
+	if len(env.To)!=2 || env.To[1].Address()!="carol@example.net" { t.Fatalf("To %+v",env.To) }
+}
+
+func TestBodyStructure(t *testing.T) {
+	bs := parseMessage([]byte(testMessage)).bodyStructure(true)
+	if bs.MIMEType!="multipart" || bs.MIMESubType!="mixed" || len(bs.Parts)!=2 { t.Fatalf("%+v",bs) }
+	text := bs.Parts[0]
+	if text.MIMEType!="text" || text.Params["charset"]!="utf-8" || text.Encoding!="7bit" || text.Size!=11 || text.Lines!=2 { t.Fatalf("text part %+v",text) }
+	msg := bs.Parts[1]
+	if msg.MIMEType!="message" || msg.MIMESubType!="rfc822" || msg.Disposition!="attachment" || msg.DispositionParams["filename"]!="fwd.eml" { t.Fatalf("message part %+v",msg) }
+	if msg.Envelope==nil || msg.Envelope.Subject!="forwarded" { t.Fatal("enclosed envelope",msg.Envelope) }
+	if msg.BodyStructure==nil || msg.BodyStructure.MIMEType!="text" || msg.BodyStructure.Params["charset"]!="us-ascii" { t.Fatal("enclosed structure",msg.BodyStructure) }
+	
+	plain := parseMessage([]byte("Subject: x\r\n\r\nhello\r\n")).bodyStructure(false)
+	if plain.MIMEType!="text" || plain.MIMESubType!="plain" || plain.Extended || plain.Lines!=1 { t.Fatalf("%+v",plain) }
+}
+
+func TestBodySection(t *testing.T) {
+	p := parseMessage([]byte(testMessage))
+	tests := []struct{ name, want string }{
+		{"BODY[]",testMessage},
+		{"BODY[HEADER.FIELDS (SUBJECT to)]","To: bob@example.org, Carol <carol@example.net>\r\nSubject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n\r\n"},
+		{"BODY[HEADER.FIELDS.NOT (From To Subject Date Message-Id Mime-Version)]","Content-Type: multipart/mixed; boundary=\"b1\"\r\n\r\n"},
+		{"BODY[1]","first\r\npart"},
+		{"BODY[1.MIME]","Content-Type: text/plain; charset=utf-8\r\n\r\n"},
+		{"BODY[2.HEADER]","From: dave@example.com\r\nSubject: forwarded\r\n\r\n"},
+		{"BODY[2.TEXT]","inner body"},
+		{"BODY[2.1]","inner body"},
+		{"BODY.PEEK[1]<2.3>","rst"},
+		{"BODY[3]",""},
+		{"BODY[1.HEADER]",""},
+	}
+	for _,tt := range tests {
+		if got := section(t,p,tt.name); got!=tt.want { t.Errorf("%s: %q, want %q",tt.name,got,tt.want) }
+	}
+	if !strings.HasPrefix(section(t,p,"BODY[TEXT]"),"preamble\r\n--b1\r\n") { t.Error("TEXT") }
+	
+	plain := parseMessage([]byte("Subject: x\r\n\r\nhello\r\n"))
+	if got := section(t,plain,"BODY[1]"); got!="hello\r\n" { t.Errorf("BODY[1] of a single part message: %q",got) }
+}
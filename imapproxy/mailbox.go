@@ -0,0 +1,310 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package imapproxy
+
+import "github.com/a-mail-group/ampp/imapio"
+import "github.com/a-mail-group/ampp/crypto/boxpgp"
+import "github.com/emersion/go-imap"
+import "github.com/emersion/go-imap/backend"
+import message "github.com/emersion/go-message"
+import "bytes"
+import "io/ioutil"
+import "sort"
+import "time"
+
+/*
+A mailbox on the upstream server. Sequence numbers and UIDs are the ones of
+the upstream server.
+*/
+type mailbox struct{
+	u *user
+	info *imap.MailboxInfo
+}
+
+var _ backend.Mailbox = (*mailbox)(nil)
+
+func (m *mailbox) Name() string { return m.info.Name }
+
+func (m *mailbox) Info() (*imap.MailboxInfo, error) { return m.info,nil }
+
+/*
+Selects the mailbox upstream, unless it is already selected. Must be called
+with u.lock held.
+*/
+func (m *mailbox) selectUpstream() error {
+	cur := m.u.c.Mailbox()
+	if cur!=nil && cur.Name==m.info.Name && !cur.ReadOnly { return nil }
+	_,err := m.u.c.Select(m.info.Name,false)
+	return err
+}
+
+func (m *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	m.u.lock.Lock()
+	defer m.u.lock.Unlock()
+	return m.u.c.Status(m.info.Name,items)
+}
+
+func (m *mailbox) SetSubscribed(subscribed bool) error {
+	m.u.lock.Lock()
+	defer m.u.lock.Unlock()
+	if subscribed { return m.u.c.Subscribe(m.info.Name) }
+	return m.u.c.Unsubscribe(m.info.Name)
+}
+
+func (m *mailbox) Check() error {
+	m.u.lock.Lock()
+	defer m.u.lock.Unlock()
+	err := m.selectUpstream()
+	if err!=nil { return err }
+	return m.u.c.Check()
+}
+
+/*
+Fetches messages from upstream. Must be called with u.lock held. The
+messages are passed to f with the stored message, if content is set. The
+first error of f is returned, after all messages have been received.
+*/
+func (m *mailbox) fetchRaw(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, content *imap.BodySectionName, f func(msg *imap.Message, data []byte) error) error {
+	err := m.selectUpstream()
+	if err!=nil { return err }
+	if content!=nil { items = append(items,content.FetchItem()) }
+	msgs := make(chan *imap.Message,16)
+	done := make(chan error,1)
+	go func() {
+		if uid {
+			done <- m.u.c.UidFetch(seqset,items,msgs)
+		} else {
+			done <- m.u.c.Fetch(seqset,items,msgs)
+		}
+	}()
+	var ferr error
+	for msg := range msgs {
+		var data []byte
+		if content!=nil {
+			if l := msg.GetBody(content); l!=nil {
+				data,err = ioutil.ReadAll(l)
+				if err!=nil {
+					if ferr==nil { ferr = err }
+					continue
+				}
+			}
+		}
+		if ferr!=nil { continue }
+		ferr = f(msg,data)
+	}
+	err = <-done
+	if err==nil { err = ferr }
+	return err
+}
+
+/*
+Like fetchRaw, but passes the decrypted message to f. A message, that can not
+be decrypted, is an error.
+*/
+func (m *mailbox) fetch(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, content *imap.BodySectionName, f func(msg *imap.Message, raw []byte)) error {
+	return m.fetchRaw(uid,seqset,items,content,func(msg *imap.Message, data []byte) error {
+		var raw []byte
+		if data!=nil {
+			var err error
+			raw,err = m.u.open(data)
+			if err!=nil { return err }
+		}
+		f(msg,raw)
+		return nil
+	})
+}
+
+func (m *mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+	
+	// The content is fetched as a whole and decrypted. A non-peek section
+	// sets \Seen upstream. The size is the one of the stored message.
+	var content *imap.BodySectionName
+	upstream := []imap.FetchItem{imap.FetchUid}
+	for _,item := range items {
+		switch item {
+		case imap.FetchEnvelope,imap.FetchBody,imap.FetchBodyStructure:
+			if content==nil { content = &imap.BodySectionName{Peek:true} }
+		case imap.FetchFlags,imap.FetchInternalDate,imap.FetchRFC822Size:
+			upstream = append(upstream,item)
+		default:
+			section,err := imap.ParseBodySectionName(item)
+			if err!=nil { break }
+			if content==nil { content = &imap.BodySectionName{Peek:true} }
+			if !section.Peek { content.Peek = false }
+		}
+	}
+	
+	m.u.lock.Lock()
+	defer m.u.lock.Unlock()
+	return m.fetch(uid,seqset,upstream,content,func(msg *imap.Message, raw []byte) {
+		fetched := imap.NewMessage(msg.SeqNum,items)
+		p := parseMessage(raw)
+		for _,item := range items {
+			switch item {
+			case imap.FetchEnvelope:
+				fetched.Envelope = envelope(p.h)
+			case imap.FetchBody,imap.FetchBodyStructure:
+				fetched.BodyStructure = p.bodyStructure(item==imap.FetchBodyStructure)
+			case imap.FetchFlags:
+				fetched.Flags = msg.Flags
+			case imap.FetchInternalDate:
+				fetched.InternalDate = msg.InternalDate
+			case imap.FetchRFC822Size:
+				fetched.Size = msg.Size
+			case imap.FetchUid:
+				fetched.Uid = msg.Uid
+			default:
+				section,err := imap.ParseBodySectionName(item)
+				if err!=nil { break }
+				fetched.Body[section] = bytes.NewBuffer(p.section(section))
+			}
+		}
+		ch <- fetched
+	})
+}
+
+func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) (ids []uint32, err error) {
+	m.u.lock.Lock()
+	defer m.u.lock.Unlock()
+	err = m.selectUpstream()
+	if err!=nil { return }
+	
+	// Criteria that only concern the metadata are evaluated upstream.
+	if !needsContent(criteria) {
+		if uid { return m.u.c.UidSearch(criteria) }
+		return m.u.c.Search(criteria)
+	}
+	
+	all := new(imap.SeqSet)
+	all.AddRange(1,0)
+	
+	// Header searches for whole terms are looked up in the blind index. The
+	// messages without index are searched here.
+	if m.u.index!=nil {
+		if c,ok := indexCriteria(m.u.index,criteria); ok {
+			c.Not = append(c.Not,unindexedCriteria())
+			if uid {
+				ids,err = m.u.c.UidSearch(c)
+			} else {
+				ids,err = m.u.c.Search(c)
+			}
+			if err!=nil { return nil,err }
+			rest,err := m.u.c.Search(unindexedCriteria())
+			if err!=nil || len(rest)==0 { return ids,err }
+			all = new(imap.SeqSet)
+			all.AddNum(rest...)
+		}
+	}
+	
+	items := []imap.FetchItem{imap.FetchUid,imap.FetchFlags,imap.FetchInternalDate}
+	err = m.fetch(false,all,items,&imap.BodySectionName{Peek:true},func(msg *imap.Message, raw []byte) {
+		if !match(msg,raw,criteria) { return }
+		if uid {
+			ids = append(ids,msg.Uid)
+		} else {
+			ids = append(ids,msg.SeqNum)
+		}
+	})
+	if err!=nil { return nil,err }
+	sort.Slice(ids,func(i,j int) bool { return ids[i]<ids[j] })
+	return
+}
+
+func (m *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	raw,err := ioutil.ReadAll(body)
+	if err!=nil { return err }
+	sealed,err := m.u.seal(raw)
+	if err!=nil { return err }
+	m.u.lock.Lock()
+	defer m.u.lock.Unlock()
+	return m.u.c.Append(m.info.Name,flags,date,bytes.NewBuffer(sealed))
+}
+
+func (m *mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	m.u.lock.Lock()
+	defer m.u.lock.Unlock()
+	err := m.selectUpstream()
+	if err!=nil { return err }
+	item := imap.FormatFlagsOp(operation,true)
+	values := make([]interface{},len(flags))
+	for i,f := range flags { values[i] = f }
+	if uid { return m.u.c.UidStore(seqset,item,values,nil) }
+	return m.u.c.Store(seqset,item,values,nil)
+}
+
+func (m *mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	m.u.lock.Lock()
+	defer m.u.lock.Unlock()
+	err := m.selectUpstream()
+	if err!=nil { return err }
+	if uid { return m.u.c.UidCopy(seqset,dest) }
+	return m.u.c.Copy(seqset,dest)
+}
+
+func (m *mailbox) Expunge() error {
+	m.u.lock.Lock()
+	defer m.u.lock.Unlock()
+	err := m.selectUpstream()
+	if err!=nil { return err }
+	return m.u.c.Expunge(nil)
+}
+
+/*
+Replaces the plaintext messages in the mailbox by encrypted copies. Must be
+called with u.lock held. The upstream search skips the messages, that have
+the X-Encrypted header and an armored body; of the others, the ones that are
+sealed for the user (see boxpgp.IsEnclosed) are kept. A message, that only
+pretends to be sealed, fails to decrypt on FETCH.
+*/
+func (m *mailbox) sealIncoming() error {
+	err := m.selectUpstream()
+	if err!=nil { return err }
+	plain := imap.NewSearchCriteria()
+	encrypted := imap.NewSearchCriteria()
+	encrypted.Header.Add("X-Encrypted","ENCLOSED-OPGP")
+	encrypted.Body = []string{"-----BEGIN ENCLOSED-OPGP-----"}
+	plain.Not = []*imap.SearchCriteria{encrypted}
+	plain.WithoutFlags = []string{imap.DeletedFlag}
+	uids,err := m.u.c.UidSearch(plain)
+	if err!=nil || len(uids)==0 { return err }
+	uidset := new(imap.SeqSet)
+	uidset.AddNum(uids...)
+	
+	type sealedMsg struct{
+		uid uint32
+		flags []string
+		date time.Time
+		data []byte
+	}
+	var sealed []sealedMsg
+	items := []imap.FetchItem{imap.FetchUid,imap.FetchFlags,imap.FetchInternalDate}
+	err = m.fetchRaw(true,uidset,items,&imap.BodySectionName{Peek:true},func(msg *imap.Message, raw []byte) error {
+		if raw==nil { return nil }
+		if e,err := message.Read(bytes.NewReader(raw)); err==nil && boxpgp.IsEnclosed(e,m.u.keys) { return nil }
+		data,err := m.u.seal(raw)
+		if err!=nil { return nil }
+		var flags []string
+		for _,f := range msg.Flags {
+			if f!=imap.RecentFlag { flags = append(flags,f) }
+		}
+		sealed = append(sealed,sealedMsg{msg.Uid,flags,msg.InternalDate,data})
+		return nil
+	})
+	if err!=nil { return err }
+	done := new(imap.SeqSet)
+	for _,s := range sealed {
+		err = m.u.c.Append(m.info.Name,s.flags,s.date,bytes.NewBuffer(s.data))
+		if err!=nil { break }
+		done.AddNum(s.uid)
+	}
+	_,e := imapio.DeleteUids(m.u.c,done)
+	if err==nil { err = e }
+	return err
+}
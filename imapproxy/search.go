@@ -0,0 +1,178 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package imapproxy
+
+import "github.com/emersion/go-imap"
+import "github.com/a-mail-group/ampp/crypto/boxpgp"
+import "net/textproto"
+import "net/mail"
+import "bufio"
+import "bytes"
+import "mime"
+import "strings"
+import "time"
+
+/*
+Returns true if the criteria can only be evaluated on the decrypted message.
+*/
+func needsContent(c *imap.SearchCriteria) bool {
+	if !c.SentSince.IsZero() || !c.SentBefore.IsZero() { return true }
+	if len(c.Header)!=0 || len(c.Body)!=0 || len(c.Text)!=0 { return true }
+	if c.Larger!=0 || c.Smaller!=0 { return true }
+	for _,n := range c.Not {
+		if needsContent(n) { return true }
+	}
+	for _,o := range c.Or {
+		if needsContent(o[0]) || needsContent(o[1]) { return true }
+	}
+	return false
+}
+
+/*
+Reports, whether a header search can be answered by the blind index. The
+index matches whole terms only, while SEARCH matches substrings, so only
+whole addresses, domains and Message-Ids are looked up.
+*/
+func wholeTerm(header, query string) bool {
+	q := strings.TrimSpace(query)
+	if q=="" || strings.ContainsAny(q," \t\"") { return false }
+	switch textproto.CanonicalMIMEHeaderKey(header) {
+	case "Message-Id":
+		return strings.IndexByte(q,'@')>0
+	case "From","To","Cc","Bcc":
+		if i := strings.IndexByte(q,'@'); i>0 {
+			_,err := mail.ParseAddress(q)
+			return err==nil
+		}
+		// A domain, like "example.org" or "@example.org".
+		d := strings.TrimPrefix(q,"@")
+		if strings.IndexByte(d,'.')<1 || strings.HasSuffix(d,".") { return false }
+		for _,r := range d {
+			if !(r>='a' && r<='z' || r>='A' && r<='Z' || r>='0' && r<='9' || r=='-' || r=='.') { return false }
+		}
+		return true
+	}
+	return false
+}
+
+/*
+Translates the criteria into lookups in the blind index, if all criteria that
+need the content are searches for whole terms on indexed headers.
+*/
+func indexCriteria(key []byte, c *imap.SearchCriteria) (*imap.SearchCriteria,bool) {
+	if !c.SentSince.IsZero() || !c.SentBefore.IsZero() { return nil,false }
+	if len(c.Body)!=0 || len(c.Text)!=0 || c.Larger!=0 || c.Smaller!=0 { return nil,false }
+	r := *c
+	r.Header,r.Not,r.Or = nil,nil,nil
+	for k,vv := range c.Header {
+		for _,v := range vv {
+			if !wholeTerm(k,v) { return nil,false }
+			name,tokens := boxpgp.IndexQuery(key,k,v)
+			if name=="" { return nil,false }
+			if r.Header==nil { r.Header = make(textproto.MIMEHeader) }
+			for _,t := range tokens { r.Header.Add(name,t) }
+		}
+	}
+	for _,n := range c.Not {
+		nc,ok := indexCriteria(key,n)
+		if !ok { return nil,false }
+		r.Not = append(r.Not,nc)
+	}
+	for _,o := range c.Or {
+		a,ok := indexCriteria(key,o[0])
+		if !ok { return nil,false }
+		b,ok := indexCriteria(key,o[1])
+		if !ok { return nil,false }
+		r.Or = append(r.Or,[2]*imap.SearchCriteria{a,b})
+	}
+	return &r,true
+}
+
+/*
+Matches messages without blind index.
+*/
+func unindexedCriteria() *imap.SearchCriteria {
+	c := new(imap.SearchCriteria)
+	for _,n := range boxpgp.IndexHeaderNames() {
+		c.Not = append(c.Not,&imap.SearchCriteria{Header:textproto.MIMEHeader{n:{""}}})
+	}
+	return c
+}
+
+func contains(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s),strings.ToLower(substr))
+}
+
+func day(t time.Time) time.Time {
+	return time.Date(t.Year(),t.Month(),t.Day(),0,0,0,0,time.UTC)
+}
+
+var wordDecoder = new(mime.WordDecoder)
+
+/*
+Evaluates the search criteria on a decrypted message (RFC 3501, 6.4.4).
+*/
+func match(msg *imap.Message, raw []byte, c *imap.SearchCriteria) bool {
+	if c.SeqNum!=nil && !c.SeqNum.Contains(msg.SeqNum) { return false }
+	if c.Uid!=nil && !c.Uid.Contains(msg.Uid) { return false }
+	if !c.Since.IsZero() && day(msg.InternalDate).Before(c.Since) { return false }
+	if !c.Before.IsZero() && !day(msg.InternalDate).Before(c.Before) { return false }
+	
+	flags := make(map[string]bool)
+	for _,f := range msg.Flags { flags[f] = true }
+	for _,f := range c.WithFlags {
+		if !flags[f] { return false }
+	}
+	for _,f := range c.WithoutFlags {
+		if flags[f] { return false }
+	}
+	
+	if c.Larger!=0 && uint32(len(raw))<=c.Larger { return false }
+	if c.Smaller!=0 && uint32(len(raw))>=c.Smaller { return false }
+	
+	h,_ := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	var body []byte
+	if i := bytes.Index(raw,[]byte("\r\n\r\n")); i>=0 {
+		body = raw[i+4:]
+	} else if i := bytes.Index(raw,[]byte("\n\n")); i>=0 {
+		body = raw[i+2:]
+	}
+	
+	if !c.SentSince.IsZero() || !c.SentBefore.IsZero() {
+		t,err := mail.ParseDate(h.Get("Date"))
+		if err!=nil { return false }
+		if !c.SentSince.IsZero() && day(t).Before(c.SentSince) { return false }
+		if !c.SentBefore.IsZero() && !day(t).Before(c.SentBefore) { return false }
+	}
+	for k,want := range c.Header {
+		values,ok := h[textproto.CanonicalMIMEHeaderKey(k)]
+		for _,w := range want {
+			found := ok && w==""
+			for _,v := range values {
+				if d,err := wordDecoder.DecodeHeader(v); err==nil { v = d }
+				if contains(v,w) { found = true }
+			}
+			if !found { return false }
+		}
+	}
+	for _,w := range c.Body {
+		if !contains(string(body),w) { return false }
+	}
+	for _,w := range c.Text {
+		if !contains(string(raw),w) { return false }
+	}
+	
+	for _,n := range c.Not {
+		if match(msg,raw,n) { return false }
+	}
+	for _,o := range c.Or {
+		if !match(msg,raw,o[0]) && !match(msg,raw,o[1]) { return false }
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package imapproxy
+
+import "github.com/emersion/go-imap"
+import "github.com/a-mail-group/ampp/crypto/boxpgp"
+import "net/textproto"
+import "testing"
+
+func headerSearch(name, value string) *imap.SearchCriteria {
+	return &imap.SearchCriteria{Header:textproto.MIMEHeader{name:{value}}}
+}
+
+func TestIndexCriteria(t *testing.T) {
+	key := []byte("index key")
+	for _,q := range []struct{ name, value string; indexed bool }{
+		{"From","alice@example.org",true},
+		{"From","Alice <alice@example.org>",false},
+		{"To","example.org",true},
+		{"Cc","@example.org",true},
+		{"From","alice",false},
+		{"From","lice@",false},
+		{"From","example.",false},
+		{"Message-Id","<1@example.org>",true},
+		{"Message-Id","example.org",false},
+		{"Subject","hello",false},
+		{"X-Other","alice@example.org",false},
+	} {
+		c,ok := indexCriteria(key,headerSearch(q.name,q.value))
+		if ok!=q.indexed { t.Errorf("%s %q: indexed %v",q.name,q.value,ok); continue }
+		if !ok { continue }
+		name,tokens := boxpgp.IndexQuery(key,q.name,q.value)
+		if len(c.Header)!=1 || len(c.Header[name])!=1 || c.Header[name][0]!=tokens[0] { t.Errorf("%s %q: %v",q.name,q.value,c.Header) }
+	}
+	
+	// A substring anywhere in the criteria needs the content.
+	c := &imap.SearchCriteria{Not:[]*imap.SearchCriteria{headerSearch("From","alice@example.org")}}
+	if _,ok := indexCriteria(key,c); !ok { t.Error("NOT not indexed") }
+	c.Or = [][2]*imap.SearchCriteria{{headerSearch("To","example.org"),headerSearch("To","bob")}}
+	if _,ok := indexCriteria(key,c); ok { t.Error("substring in OR indexed") }
+}
+
+func TestUnindexedCriteria(t *testing.T) {
+	h := map[string][]string{"From":{"alice@example.org"}}
+	boxpgp.IndexHeader(h,h,[]byte("index key"))
+	indexed := "From: alice@example.org\r\n"
+	for k,v := range h {
+		if k!="From" { indexed += k+": "+v[0]+"\r\n" }
+	}
+	
+	c := unindexedCriteria()
+	msg := &imap.Message{SeqNum:1,Uid:1}
+	if match(msg,[]byte(indexed+"\r\nbody\r\n"),c) { t.Error("indexed message matched") }
+	if !match(msg,[]byte("From: alice@example.org\r\n\r\nbody\r\n"),c) { t.Error("message without index not matched") }
+}
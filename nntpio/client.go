@@ -0,0 +1,118 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+// Minimal NNTP (RFC 3977) client and server for posting news articles.
+package nntpio
+
+import "net"
+import "net/textproto"
+import "crypto/tls"
+
+type Client struct{
+	Text *textproto.Conn
+	conn net.Conn
+	
+	// False if the server said 201 in its greeting.
+	PostingAllowed bool
+}
+
+/*
+Creates a client on an established connection and reads the greeting.
+*/
+func NewClient(conn net.Conn) (*Client,error) {
+	c := &Client{Text:textproto.NewConn(conn),conn:conn}
+	code,_,err := c.Text.ReadCodeLine(20)
+	if err!=nil { c.Text.Close(); return nil,err }
+	c.PostingAllowed = code==200
+	return c,nil
+}
+
+func (c *Client) cmd(expectCode int, format string, args ...interface{}) (string,error) {
+	id,err := c.Text.Cmd(format,args...)
+	if err!=nil { return "",err }
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_,msg,err := c.Text.ReadCodeLine(expectCode)
+	return msg,err
+}
+
+/*
+Returns the capability lines, or nil if CAPABILITIES is not supported.
+*/
+func (c *Client) Capabilities() (capa []string) {
+	_,err := c.cmd(101,"CAPABILITIES")
+	if err!=nil { return nil }
+	capa,_ = c.Text.ReadDotLines()
+	return
+}
+
+/*
+Upgrades the connection using STARTTLS (RFC 4642).
+*/
+func (c *Client) StartTLS(config *tls.Config) error {
+	_,err := c.cmd(382,"STARTTLS")
+	if err!=nil { return err }
+	tc := tls.Client(c.conn,config)
+	err = tc.Handshake()
+	if err!=nil { return err }
+	c.conn = tc
+	c.Text = textproto.NewConn(tc)
+	return nil
+}
+
+/*
+Authenticates using AUTHINFO USER and PASS (RFC 4643).
+*/
+func (c *Client) Auth(user, pass string) error {
+	id,err := c.Text.Cmd("AUTHINFO USER %s",user)
+	if err!=nil { return err }
+	c.Text.StartResponse(id)
+	code,_,err := c.Text.ReadCodeLine(281)
+	c.Text.EndResponse(id)
+	if code!=381 { return err }
+	_,err = c.cmd(281,"AUTHINFO PASS %s",pass)
+	return err
+}
+
+/*
+Posts an article. The article must contain the Newsgroups, From and Subject
+headers. A rejected article results in a *textproto.Error with code 441, or
+440 if posting is not permitted.
+*/
+func (c *Client) Post(article []byte) error {
+	_,err := c.cmd(340,"POST")
+	if err!=nil { return err }
+	w := c.Text.DotWriter()
+	_,err = w.Write(article)
+	if err!=nil { w.Close(); return err }
+	err = w.Close()
+	if err!=nil { return err }
+	_,_,err = c.Text.ReadCodeLine(240)
+	return err
+}
+
+/*
+Ends the session and closes the connection.
+*/
+func (c *Client) Quit() error {
+	_,err := c.cmd(205,"QUIT")
+	c.Text.Close()
+	return err
+}
+
+func (c *Client) Close() error { return c.Text.Close() }
+
+/*
+Returns true if err is a permanent rejection of the article (441) or of
+posting (440), rather than a failure of the session. Retrying does not help
+in either case.
+*/
+func IsRejected(err error) bool {
+	e,ok := err.(*textproto.Error)
+	return ok && (e.Code==440 || e.Code==441)
+}
@@ -0,0 +1,58 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package nntpio
+
+import "github.com/a-mail-group/ampp/queue"
+import "io"
+
+/*
+Posts the articles in a queue to a news server.
+*/
+type Output struct{
+	Q *queue.Queue
+	N string
+	
+	Connector *Connector
+	
+	// If not empty, articles rejected by the server are moved into this
+	// queue. Otherwise they are dropped.
+	Rejected string
+}
+
+/*
+Posts all queued articles over a single connection.
+*/
+func (o *Output) Process() error {
+	c,err := o.Connector.Connect()
+	if err!=nil { return err }
+	defer c.Close()
+	return o.Q.Process(func(tx *queue.Tx) error {
+		f := tx.Fetch(o.N)
+		keys := make([][]byte,0,1024)
+		for {
+			k,m,e := f.Next()
+			if e==io.EOF { break }
+			if e!=nil { keys = append(keys,k); continue } // XXX ignores broken messages.
+			e = c.Post(m.Body)
+			if IsRejected(e) {
+				if o.Rejected!="" { tx.EnqueueMessage(o.Rejected,m) } // XXX ignore errors!
+			} else if e!=nil {
+				break // Network errors and temporary failures.
+			}
+			keys = append(keys,k)
+			if len(keys)>=1024 {
+				tx.RemoveAll(o.N,keys) // XXX ignore errors!
+				keys = keys[:0]
+			}
+		}
+		tx.RemoveAll(o.N,keys) // XXX ignore errors!
+		c.Quit()
+		return nil
+	})
+}
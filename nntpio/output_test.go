@@ -0,0 +1,87 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package nntpio
+
+import "github.com/a-mail-group/ampp/qmodel"
+import "github.com/a-mail-group/ampp/queue"
+import "io/ioutil"
+import "net"
+import "os"
+import "path/filepath"
+import "sync"
+import "testing"
+
+func TestOutput(t *testing.T) {
+	dir,err := ioutil.TempDir("","nntp")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	q,err := queue.Open(filepath.Join(dir,"queue.db"))
+	if err!=nil { t.Fatal(err) }
+	defer q.Close()
+	count := func(name string) (n int) {
+		err := q.Process(func(tx *queue.Tx) error {
+			f := tx.Fetch(name)
+			for {
+				_,_,err := f.Next()
+				if err!=nil { return nil }
+				n++
+			}
+		})
+		if err!=nil { t.Fatal(err) }
+		return
+	}
+	
+	var lock sync.Mutex
+	var posted []string
+	var listeners []net.Listener
+	defer func() {
+		for _,l := range listeners { l.Close() }
+	}()
+	serve := func(s *Server) string {
+		s.Username,s.Password = "poster","secret"
+		s.Post = func(article []byte) error {
+			lock.Lock()
+			defer lock.Unlock()
+			posted = append(posted,string(article))
+			return nil
+		}
+		l,err := net.Listen("tcp","127.0.0.1:0")
+		if err!=nil { t.Fatal(err) }
+		listeners = append(listeners,l)
+		go s.Serve(l)
+		return l.Addr().String()
+	}
+	o := &Output{Q:q,N:"news",Rejected:"rejected",Connector:&Connector{Addr:serve(&Server{}),NoTLS:true,Username:"poster",Password:"secret"}}
+	
+	article := "Newsgroups: alt.test\r\nFrom: a@example.org\r\nSubject: hello\r\n\r\n.dot\r\nbody\r\n"
+	for _,body := range []string{article,"From: a@example.org\r\nSubject: no groups\r\n\r\nbody\r\n"} {
+		err = q.EnqueueMessage("news",&qmodel.Message{Newsgroups:[]string{"alt.test"},Body:[]byte(body)})
+		if err!=nil { t.Fatal(err) }
+	}
+	err = o.Process()
+	if err!=nil { t.Fatal(err) }
+	if len(posted)!=1 || posted[0]!=article { t.Fatalf("posted %q",posted) }
+	// 441: the article without Newsgroups is rejected.
+	if n := count("rejected"); n!=1 { t.Fatalf("%d articles rejected",n) }
+	if n := count("news"); n!=0 { t.Fatalf("%d articles left",n) }
+	
+	// 440: posting is not permitted, the article is rejected too.
+	o.Connector.Addr = serve(&Server{NoPosting:true})
+	err = q.EnqueueMessage("news",&qmodel.Message{Newsgroups:[]string{"alt.test"},Body:[]byte(article)})
+	if err!=nil { t.Fatal(err) }
+	err = o.Process()
+	if err!=nil { t.Fatal(err) }
+	if len(posted)!=1 { t.Fatalf("posted %d articles",len(posted)) }
+	if n := count("rejected"); n!=2 { t.Fatalf("%d articles rejected",n) }
+	if n := count("news"); n!=0 { t.Fatalf("%d articles left",n) }
+	
+	// A wrong password is a failure of the session.
+	o.Connector.Password = "wrong"
+	if o.Process()==nil { t.Fatal("login with a wrong password") }
+}
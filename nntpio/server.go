@@ -0,0 +1,131 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package nntpio
+
+import "net"
+import "net/textproto"
+import "bytes"
+import "strings"
+
+/*
+A minimal NNTP server that only accepts POST. It is an in-process stand-in for
+a news server, for example to test an Output or to hand articles over to
+another transport.
+*/
+type Server struct{
+	// Called for every posted article, with CRLF line endings. An error
+	// rejects the article with 441.
+	Post func(article []byte) error
+	
+	// If Username is not empty, AUTHINFO is required before POST.
+	Username, Password string
+	
+	// If set, the server greets with 201 and refuses POST with 440.
+	NoPosting bool
+}
+
+/*
+Accepts connections until the listener is closed.
+*/
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn,err := l.Accept()
+		if err!=nil { return err }
+		go s.ServeConn(conn)
+	}
+}
+
+/*
+Reads a dot-terminated block. Unlike textproto.DotReader, line endings are
+kept as CRLF.
+*/
+func readDotBlock(r *textproto.Reader) ([]byte,error) {
+	buf := new(bytes.Buffer)
+	for {
+		line,err := r.ReadLine()
+		if err!=nil { return nil,err }
+		if line=="." { break }
+		if strings.HasPrefix(line,".") { line = line[1:] }
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes(),nil
+}
+
+func hasNewsgroups(article []byte) bool {
+	for _,line := range bytes.Split(article,[]byte("\r\n")) {
+		if len(line)==0 { break }
+		if i := bytes.IndexByte(line,':'); i>0 && strings.EqualFold(string(line[:i]),"Newsgroups") { return true }
+	}
+	return false
+}
+
+/*
+Serves a single connection.
+*/
+func (s *Server) ServeConn(conn net.Conn) {
+	t := textproto.NewConn(conn)
+	defer t.Close()
+	authed := s.Username==""
+	var user string
+	greeting := "200 Posting allowed"
+	if s.NoPosting { greeting = "201 Posting prohibited" }
+	t.PrintfLine("%s",greeting)
+	for {
+		line,err := t.ReadLine()
+		if err!=nil { return }
+		f := strings.Fields(line)
+		if len(f)==0 { t.PrintfLine("500 Unknown command"); continue }
+		switch strings.ToUpper(f[0]) {
+		case "CAPABILITIES":
+			t.PrintfLine("101 Capability list:")
+			dw := t.DotWriter()
+			dw.Write([]byte("VERSION 2\nPOST\n"))
+			if !authed { dw.Write([]byte("AUTHINFO USER\n")) }
+			dw.Close()
+		case "MODE":
+			t.PrintfLine("%s",greeting)
+		case "AUTHINFO":
+			switch {
+			case authed:
+				t.PrintfLine("502 Already authenticated")
+			case len(f)==3 && strings.EqualFold(f[1],"USER"):
+				user = f[2]
+				t.PrintfLine("381 Password required")
+			case len(f)==3 && strings.EqualFold(f[1],"PASS") && user!="":
+				if user==s.Username && f[2]==s.Password {
+					authed = true
+					t.PrintfLine("281 Authentication accepted")
+				} else {
+					user = ""
+					t.PrintfLine("481 Authentication failed")
+				}
+			default:
+				t.PrintfLine("482 Authentication commands issued out of sequence")
+			}
+		case "POST":
+			if !authed { t.PrintfLine("480 Authentication required"); continue }
+			if s.NoPosting { t.PrintfLine("440 Posting not permitted"); continue }
+			t.PrintfLine("340 Send article")
+			article,err := readDotBlock(&t.Reader)
+			if err!=nil { return }
+			if !hasNewsgroups(article) { t.PrintfLine("441 No Newsgroups header"); continue }
+			if s.Post!=nil {
+				err = s.Post(article)
+				if err!=nil { t.PrintfLine("441 %s",err); continue }
+			}
+			t.PrintfLine("240 Article received")
+		case "QUIT":
+			t.PrintfLine("205 Bye")
+			return
+		default:
+			t.PrintfLine("500 Unknown command")
+		}
+	}
+}
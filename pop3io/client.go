@@ -0,0 +1,165 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+// Minimal POP3 (RFC 1939) client for upstream mailboxes.
+package pop3io
+
+import "net"
+import "net/textproto"
+import "crypto/tls"
+import "bytes"
+import "errors"
+import "strconv"
+import "strings"
+
+/*
+A -ERR response from the server.
+*/
+type Error string
+func (e Error) Error() string { return "pop3: "+string(e) }
+
+var (
+	EBadResponse = errors.New("pop3: malformed response")
+)
+
+type Client struct{
+	Text *textproto.Conn
+	conn net.Conn
+}
+
+/*
+Creates a client on an established connection and reads the greeting.
+*/
+func NewClient(conn net.Conn) (*Client,error) {
+	c := &Client{textproto.NewConn(conn),conn}
+	_,err := c.response()
+	if err!=nil { c.Text.Close(); return nil,err }
+	return c,nil
+}
+
+func (c *Client) response() (string,error) {
+	line,err := c.Text.ReadLine()
+	if err!=nil { return "",err }
+	switch {
+	case strings.HasPrefix(line,"+OK"): return strings.TrimSpace(line[3:]),nil
+	case strings.HasPrefix(line,"-ERR"): return "",Error(strings.TrimSpace(line[4:]))
+	}
+	return "",EBadResponse
+}
+
+func (c *Client) cmd(format string, args ...interface{}) (string,error) {
+	err := c.Text.PrintfLine(format,args...)
+	if err!=nil { return "",err }
+	return c.response()
+}
+
+/*
+Reads a multi-line response. Unlike textproto.DotReader, line endings are
+kept as CRLF.
+*/
+func (c *Client) readMulti() ([]byte,error) {
+	buf := new(bytes.Buffer)
+	for {
+		line,err := c.Text.ReadLine()
+		if err!=nil { return nil,err }
+		if line=="." { break }
+		if strings.HasPrefix(line,".") { line = line[1:] }
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes(),nil
+}
+
+/*
+Returns the capability lines (RFC 2449), or nil if CAPA is not supported.
+*/
+func (c *Client) Capabilities() (capa []string) {
+	_,err := c.cmd("CAPA")
+	if err!=nil { return nil }
+	data,err := c.readMulti()
+	if err!=nil { return nil }
+	for _,line := range strings.Split(string(data),"\r\n") {
+		if line!="" { capa = append(capa,line) }
+	}
+	return
+}
+
+/*
+Upgrades the connection using STLS (RFC 2595).
+*/
+func (c *Client) StartTLS(config *tls.Config) error {
+	_,err := c.cmd("STLS")
+	if err!=nil { return err }
+	tc := tls.Client(c.conn,config)
+	err = tc.Handshake()
+	if err!=nil { return err }
+	c.conn = tc
+	c.Text = textproto.NewConn(tc)
+	return nil
+}
+
+/*
+Authenticates using USER and PASS.
+*/
+func (c *Client) Auth(user, pass string) error {
+	_,err := c.cmd("USER %s",user)
+	if err!=nil { return err }
+	_,err = c.cmd("PASS %s",pass)
+	return err
+}
+
+type UidlEntry struct{
+	Num int
+	Uid string
+}
+
+/*
+Lists the unique ids of all messages in the maildrop.
+*/
+func (c *Client) Uidl() (list []UidlEntry,err error) {
+	_,err = c.cmd("UIDL")
+	if err!=nil { return }
+	data,err := c.readMulti()
+	if err!=nil { return }
+	for _,line := range strings.Split(string(data),"\r\n") {
+		f := strings.Fields(line)
+		if len(f)!=2 { continue }
+		n,e := strconv.Atoi(f[0])
+		if e!=nil { err = EBadResponse; return }
+		list = append(list,UidlEntry{n,f[1]})
+	}
+	return
+}
+
+/*
+Retrieves a message.
+*/
+func (c *Client) Retr(num int) ([]byte,error) {
+	_,err := c.cmd("RETR %d",num)
+	if err!=nil { return nil,err }
+	return c.readMulti()
+}
+
+/*
+Marks a message as deleted. It is removed when the session ends with Quit().
+*/
+func (c *Client) Dele(num int) error {
+	_,err := c.cmd("DELE %d",num)
+	return err
+}
+
+/*
+Ends the session, committing deletions, and closes the connection.
+*/
+func (c *Client) Quit() error {
+	_,err := c.cmd("QUIT")
+	c.Text.Close()
+	return err
+}
+
+func (c *Client) Close() error { return c.Text.Close() }
@@ -0,0 +1,41 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package pop3io
+
+import "github.com/a-mail-group/ampp/dialer"
+import "errors"
+
+var (
+	ENoStartTLS = errors.New("POP3 server does not support STLS")
+)
+
+/*
+Connects to a POP3 server using a pluggable dialer. Implicit TLS uses port
+995.
+*/
+type Connector dialer.Connector
+
+/*
+Dials, negotiates TLS and authenticates.
+*/
+func (c *Connector) Connect() (cl *Client,err error) {
+	dc := (*dialer.Connector)(c)
+	conn,err := dc.Dial()
+	if err!=nil { return }
+	cl,err = NewClient(conn)
+	if err!=nil { return }
+	if dc.NeedStartTLS() {
+		if !dialer.HasCapability(cl.Capabilities(),"STLS") { err = ENoStartTLS; cl.Close(); cl = nil; return }
+		err = cl.StartTLS(dc.TLSConfig())
+		if err!=nil { cl.Close(); cl = nil; return }
+	}
+	err = cl.Auth(c.Username,c.Password)
+	if err!=nil { cl.Close(); cl = nil; return }
+	return
+}
@@ -13,5 +13,8 @@ type Message struct{
 	From string
 	To []string
 	Body []byte
+	
+	// If not empty, Body is a news article to be posted to these newsgroups.
+	Newsgroups []string `msgpack:",omitempty"`
 }
 
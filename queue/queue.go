@@ -16,9 +16,17 @@ import "github.com/vmihailenco/msgpack"
 import "io/ioutil"
 import "io"
 import "time"
+import "encoding/binary"
+import "crypto/rand"
+import "crypto/subtle"
+import "errors"
 
 import "github.com/a-mail-group/ampp/qmodel"
 
+var (
+	ELeaseLost = errors.New("Lease expired and taken over by another consumer")
+)
+
 type Queue struct{
 	DB *bolt.DB
 }
@@ -32,14 +40,152 @@ func (q *Queue) Process(f func(*Tx) error) error {
 	return q.DB.Batch(func(tx *bolt.Tx) error { return f(&Tx{tx}) })
 }
 
+/*
+Enqueues a message in its own transaction.
+*/
+func (q *Queue) EnqueueMessage(queue string,msg *qmodel.Message) error {
+	return q.Process(func(tx *Tx) error { return tx.EnqueueMessage(queue,msg) })
+}
+
+/*
+Like Tx.EnqueueMessageOnce(), in its own transaction.
+*/
+func (q *Queue) EnqueueMessageOnce(queue string,id []byte,msg *qmodel.Message) (dup bool,err error) {
+	err = q.Process(func(tx *Tx) error {
+		var e error
+		dup,e = tx.EnqueueMessageOnce(queue,id,msg)
+		return e
+	})
+	return
+}
+
+/*
+Like Tx.ExpireIds(), in its own transaction.
+*/
+func (q *Queue) ExpireIds(queue string,t time.Time) error {
+	return q.DB.Update(func(tx *bolt.Tx) error { return (&Tx{tx}).ExpireIds(queue,t) })
+}
+
+/*
+Leases up to n messages from the queue for the duration d, in its own
+transaction. The leased messages are invisible to other consumers until they
+are acknowledged with Ack() or the lease expires, so the caller can perform
+network I/O without holding the database lock.
+*/
+func (q *Queue) Lease(queue string,n int,d time.Duration) (leases []*Lease,err error) {
+	err = q.DB.Update(func(tx *bolt.Tx) error {
+		var e error
+		leases,e = (&Tx{tx}).Lease(queue,n,d)
+		return e
+	})
+	return
+}
+
+/*
+Removes a leased message from the queue. It fails with ELeaseLost, if the
+lease has been taken over by another consumer.
+*/
+func (q *Queue) Ack(queue string,l *Lease) error {
+	return q.DB.Update(func(tx *bolt.Tx) error { return (&Tx{tx}).Ack(queue,l) })
+}
+
+/*
+Gives up the lease on a message, making it visible to other consumers again.
+It fails with ELeaseLost, if the lease has been taken over by another
+consumer.
+*/
+func (q *Queue) Release(queue string,l *Lease) error {
+	return q.DB.Update(func(tx *bolt.Tx) error { return (&Tx{tx}).Release(queue,l) })
+}
+
 type Tx struct{
 	tx *bolt.Tx
 }
+
+// A message that has been leased from the queue. Msg is nil if the stored
+// message could not be decoded. Token identifies the holder of the lease.
+type Lease struct{
+	Key []byte
+	Msg *qmodel.Message
+	Expires time.Time
+	Token []byte
+}
+
+// The lease bucket holds the expiry time (8 bytes) followed by the token.
+const leaseTokenSize = 16
+
+// The bucket holding the lease expiry times of a queue.
+func leaseBucket(queue string) []byte {
+	return []byte("\x00lease\x00"+queue)
+}
+
+// The bucket holding the idempotency keys of a queue.
+func idBucket(queue string) []byte {
+	return []byte("\x00ids\x00"+queue)
+}
+
+func (tx *Tx) leased(lbkt *bolt.Bucket,key []byte,now time.Time) bool {
+	if lbkt==nil { return false }
+	v := lbkt.Get(key)
+	if len(v)<8 { return false }
+	return int64(binary.BigEndian.Uint64(v)) > now.UnixNano()
+}
 func (tx *Tx) EnqueueMessage(queue string,msg *qmodel.Message) error {
 	key := make([]byte,0,len(time.RFC3339Nano))
 	key = time.Now().UTC().AppendFormat(key,time.RFC3339Nano)
 	return tx.ReEnqueueMessage(key,queue,msg)
 }
+/*
+Enqueues a message unless a message with the same idempotency key has been
+enqueued before. The key identifies the source message (for example its
+IMAP UIDVALIDITY and UID), so that a message that is ingested twice, because
+the source could not be updated after enqueueing, is only enqueued once.
+
+The keys outlive the messages, as the first copy may already be delivered;
+see ExpireIds().
+*/
+func (tx *Tx) EnqueueMessageOnce(queue string,id []byte,msg *qmodel.Message) (dup bool,err error) {
+	ibkt,err := tx.tx.CreateBucketIfNotExists(idBucket(queue))
+	if err!=nil { return }
+	if ibkt.Get(id)!=nil { dup = true; return }
+	now := time.Now()
+	key := make([]byte,0,len(time.RFC3339Nano))
+	key = now.UTC().AppendFormat(key,time.RFC3339Nano)
+	err = tx.ReEnqueueMessage(key,queue,msg)
+	if err!=nil { return }
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:],uint64(now.UnixNano()))
+	err = ibkt.Put(id,v[:])
+	return
+}
+
+/*
+Returns the time an idempotency key was stored. A broken value gives the zero
+time, so that the key expires.
+*/
+func idTime(v []byte) time.Time {
+	if len(v)!=8 { return time.Time{} }
+	return time.Unix(0,int64(binary.BigEndian.Uint64(v)))
+}
+
+/*
+Removes the idempotency keys of messages enqueued before t.
+*/
+func (tx *Tx) ExpireIds(queue string,t time.Time) error {
+	ibkt := tx.tx.Bucket(idBucket(queue))
+	if ibkt==nil { return nil }
+	var old [][]byte
+	ibkt.ForEach(func(k,v []byte) error {
+		if idTime(v).Before(t) { old = append(old,append([]byte(nil),k...)) }
+		return nil
+	})
+	for _,k := range old {
+		err := ibkt.Delete(k)
+		if err!=nil { return err }
+	}
+	return nil
+}
+
 func (tx *Tx) ReEnqueueMessage(key []byte,queue string,msg *qmodel.Message) error {
 	data,err := msgpack.Marshal(msg)
 	if err!=nil { return err }
@@ -52,7 +198,11 @@ func (tx *Tx) ReEnqueueMessage(key []byte,queue string,msg *qmodel.Message) erro
 func (tx *Tx) Peek(queue string) (key []byte,msg *qmodel.Message,err error) {
 	bkt := tx.tx.Bucket([]byte(queue))
 	if bkt==nil { err = io.EOF; return }
-	k,v := bkt.Cursor().First()
+	lbkt := tx.tx.Bucket(leaseBucket(queue))
+	now := time.Now()
+	c := bkt.Cursor()
+	k,v := c.First()
+	for len(k)!=0 && tx.leased(lbkt,k,now) { k,v = c.Next() }
 	if len(k)==0 { err = io.EOF; return }
 	msg = new(qmodel.Message)
 	err = msgpack.Unmarshal(v,msg)
@@ -65,22 +215,29 @@ func (tx *Tx) Peek(queue string) (key []byte,msg *qmodel.Message,err error) {
 func (tx *Tx) Fetch(queue string) *Fetch {
 	bkt := tx.tx.Bucket([]byte(queue))
 	if bkt==nil { return &Fetch{} }
-	return &Fetch{false,bkt.Cursor()}
+	return &Fetch{false,bkt.Cursor(),tx,tx.tx.Bucket(leaseBucket(queue)),time.Now()}
 }
 
+/*
+Iterates over the messages in a queue, skipping leased messages.
+*/
 type Fetch struct{
 	b bool
 	c *bolt.Cursor
+	tx *Tx
+	l *bolt.Bucket
+	now time.Time
 }
 func (f *Fetch) Next() (key []byte,msg *qmodel.Message,err error) {
 	var k,v []byte
 	if f.c==nil { err = io.EOF; return }
-	if f.b {
+	if !f.b {
 		k,v = f.c.First()
 		f.b = true
 	} else {
 		k,v = f.c.Next()
 	}
+	for len(k)!=0 && f.tx.leased(f.l,k,f.now) { k,v = f.c.Next() }
 	if len(k)==0 { err = io.EOF; return }
 	msg = new(qmodel.Message)
 	err = msgpack.Unmarshal(v,msg)
@@ -90,15 +247,89 @@ func (f *Fetch) Next() (key []byte,msg *qmodel.Message,err error) {
 	return
 }
 
+/*
+Leases up to n visible messages from the queue for the duration d. Expired
+leases are taken over. The messages stay in the queue until they are removed
+(see Ack() and Remove()).
+*/
+func (tx *Tx) Lease(queue string,n int,d time.Duration) (leases []*Lease,err error) {
+	bkt := tx.tx.Bucket([]byte(queue))
+	if bkt==nil { return }
+	lbkt,err := tx.tx.CreateBucketIfNotExists(leaseBucket(queue))
+	if err!=nil { return }
+	now := time.Now()
+	exp := now.Add(d)
+	c := bkt.Cursor()
+	for k,v := c.First(); len(k)!=0 && len(leases)<n; k,v = c.Next() {
+		if tx.leased(lbkt,k,now) { continue }
+		msg := new(qmodel.Message)
+		if msgpack.Unmarshal(v,msg)!=nil { msg = nil }
+		key := make([]byte,len(k))
+		copy(key,k)
+		lv := make([]byte,8+leaseTokenSize)
+		binary.BigEndian.PutUint64(lv,uint64(exp.UnixNano()))
+		_,err = rand.Read(lv[8:])
+		if err!=nil { return }
+		err = lbkt.Put(key,lv)
+		if err!=nil { return }
+		leases = append(leases,&Lease{key,msg,exp,lv[8:]})
+	}
+	return
+}
+
+/*
+Checks, that l still holds the lease on its message. An expired lease, that
+has not been taken over, is still held.
+*/
+func (tx *Tx) holds(queue string,l *Lease) bool {
+	lbkt := tx.tx.Bucket(leaseBucket(queue))
+	if lbkt==nil { return false }
+	v := lbkt.Get(l.Key)
+	if len(v)!=8+leaseTokenSize { return false }
+	return subtle.ConstantTimeCompare(v[8:],l.Token)==1
+}
+
+/*
+Acknowledges a leased message and removes it from the queue. It fails with
+ELeaseLost, if the lease has been taken over by another consumer.
+*/
+func (tx *Tx) Ack(queue string,l *Lease) error {
+	if !tx.holds(queue,l) { return ELeaseLost }
+	return tx.Remove(queue,l.Key)
+}
+
+/*
+Gives up the lease on a message, making it visible to other consumers again.
+It fails with ELeaseLost, if the lease has been taken over by another
+consumer.
+*/
+func (tx *Tx) Release(queue string,l *Lease) error {
+	if !tx.holds(queue,l) { return ELeaseLost }
+	return tx.unlease(queue,l.Key)
+}
+
+func (tx *Tx) unlease(queue string,key []byte) error {
+	lbkt := tx.tx.Bucket(leaseBucket(queue))
+	if lbkt==nil { return nil }
+	return lbkt.Delete(key)
+}
+
 func (tx *Tx) Remove(queue string,key []byte) error {
 	bkt := tx.tx.Bucket([]byte(queue))
 	if bkt==nil { return nil }
+	err := tx.unlease(queue,key)
+	if err!=nil { return err }
 	return bkt.Delete(key)
 }
 func (tx *Tx) RemoveAll(queue string,keys [][]byte) error {
 	bkt := tx.tx.Bucket([]byte(queue))
 	if bkt==nil { return nil }
+	lbkt := tx.tx.Bucket(leaseBucket(queue))
 	for _,key := range keys {
+		if lbkt!=nil {
+			err := lbkt.Delete(key)
+			if err!=nil { return err }
+		}
 		err := bkt.Delete(key)
 		if err!=nil { return err }
 	}
@@ -109,6 +340,6 @@ func (tx *Tx) Enqueue(queue string,from string, to []string, r io.Reader) error
 	data,err := ioutil.ReadAll(r)
 	if err!=nil { return err }
 	if len(data) > 3<<9 { return smtp.ErrDataTooLarge }
-	return tx.EnqueueMessage(queue,&qmodel.Message{from,to,data})
+	return tx.EnqueueMessage(queue,&qmodel.Message{From:from,To:to,Body:data})
 }
 
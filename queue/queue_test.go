@@ -0,0 +1,106 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package queue
+
+import "github.com/a-mail-group/ampp/qmodel"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func openTemp(t *testing.T) (*Queue,func()) {
+	dir,err := ioutil.TempDir("","queue")
+	if err!=nil { t.Fatal(err) }
+	q,err := Open(filepath.Join(dir,"q.db"))
+	if err!=nil { os.RemoveAll(dir); t.Fatal(err) }
+	return q,func() { q.Close(); os.RemoveAll(dir) }
+}
+
+func count(t *testing.T,q *Queue,name string) (n int) {
+	err := q.Process(func(tx *Tx) error {
+		f := tx.Fetch(name)
+		for {
+			_,_,err := f.Next()
+			if err!=nil { return nil }
+			n++
+		}
+	})
+	if err!=nil { t.Fatal(err) }
+	return
+}
+
+func TestLease(t *testing.T) {
+	q,done := openTemp(t)
+	defer done()
+	for _,to := range []string{"a@example.org","b@example.org"} {
+		err := q.EnqueueMessage("out",&qmodel.Message{From:"x@example.org",To:[]string{to},Body:[]byte("hello")})
+		if err!=nil { t.Fatal(err) }
+		time.Sleep(time.Millisecond) // Distinct keys.
+	}
+	
+	l1,err := q.Lease("out",1,time.Hour)
+	if err!=nil || len(l1)!=1 { t.Fatal(l1,err) }
+	if l1[0].Msg.To[0]!="a@example.org" { t.Fatal(l1[0].Msg) }
+	if count(t,q,"out")!=1 { t.Fatal("leased message is visible") }
+	
+	l2,err := q.Lease("out",10,time.Hour)
+	if err!=nil || len(l2)!=1 || l2[0].Msg.To[0]!="b@example.org" { t.Fatal(l2,err) }
+	
+	err = q.Release("out",l2[0])
+	if err!=nil { t.Fatal(err) }
+	if count(t,q,"out")!=1 { t.Fatal("released message is invisible") }
+	
+	err = q.Ack("out",l1[0])
+	if err!=nil { t.Fatal(err) }
+	l3,err := q.Lease("out",10,time.Hour)
+	if err!=nil || len(l3)!=1 || l3[0].Msg.To[0]!="b@example.org" { t.Fatal(l3,err) }
+}
+
+func TestLeaseTakeover(t *testing.T) {
+	q,done := openTemp(t)
+	defer done()
+	err := q.EnqueueMessage("out",&qmodel.Message{To:[]string{"a@example.org"}})
+	if err!=nil { t.Fatal(err) }
+	
+	old,err := q.Lease("out",1,time.Millisecond)
+	if err!=nil || len(old)!=1 { t.Fatal(old,err) }
+	time.Sleep(5*time.Millisecond)
+	cur,err := q.Lease("out",1,time.Hour)
+	if err!=nil || len(cur)!=1 { t.Fatal("expired lease not taken over",err) }
+	
+	// The first consumer lost its lease and must not touch the message.
+	if err = q.Ack("out",old[0]); err!=ELeaseLost { t.Fatal("Ack:",err) }
+	if err = q.Release("out",old[0]); err!=ELeaseLost { t.Fatal("Release:",err) }
+	if count(t,q,"out")!=0 { t.Fatal("lease of the new holder was released") }
+	
+	err = q.Ack("out",cur[0])
+	if err!=nil { t.Fatal(err) }
+	if l,_ := q.Lease("out",1,time.Hour); len(l)!=0 { t.Fatal("acked message still queued") }
+}
+
+func TestEnqueueOnce(t *testing.T) {
+	q,done := openTemp(t)
+	defer done()
+	msg := &qmodel.Message{To:[]string{"a@example.org"},Body:[]byte("hello")}
+	dup,err := q.EnqueueMessageOnce("in",[]byte("imap:x;UID=1"),msg)
+	if err!=nil || dup { t.Fatal(dup,err) }
+	dup,err = q.EnqueueMessageOnce("in",[]byte("imap:x;UID=1"),msg)
+	if err!=nil || !dup { t.Fatal("duplicate not detected",err) }
+	if count(t,q,"in")!=1 { t.Fatal("duplicate enqueued") }
+	
+	// Keys younger than the limit are kept.
+	err = q.ExpireIds("in",time.Now().Add(-time.Hour))
+	if err!=nil { t.Fatal(err) }
+	if dup,_ = q.EnqueueMessageOnce("in",[]byte("imap:x;UID=1"),msg); !dup { t.Fatal("key expired early") }
+	
+	err = q.ExpireIds("in",time.Now().Add(time.Second))
+	if err!=nil { t.Fatal(err) }
+	if dup,_ = q.EnqueueMessageOnce("in",[]byte("imap:x;UID=1"),msg); dup { t.Fatal("key not expired") }
+}
@@ -0,0 +1,275 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+
+package handler
+
+import "github.com/a-mail-group/ampp/remailer/cypherpunk"
+import "github.com/a-mail-group/ampp/qmodel"
+import bolt "github.com/coreos/bbolt"
+import "bufio"
+import "bytes"
+import "crypto/rand"
+import "encoding/binary"
+import "encoding/hex"
+import "fmt"
+import "net/mail"
+import "net/textproto"
+import "regexp"
+import "strings"
+import "time"
+
+var bBlockList = []byte("blocklist")
+var bBlockPending = []byte("blocklist-pending")
+var kBlockedCount = []byte("#blocked")
+
+/*
+The destinations that must never receive remailed mail, persisted in BoltDB.
+Entries are addresses, domains or regular expressions (matched against the
+normalized address).
+
+Users can block themselves by sending a message with the subject
+"destination-block" to the remailer. As the From header is easily forged,
+the address is not blocked right away: a confirmation request carrying a
+random nonce is mailed to it, and the address is blocked once a message with
+the subject "destination-block <nonce>" comes back.
+*/
+type BlockList struct{
+	DB *bolt.DB
+	
+	// The confirmation requests are enqueued here, with Address as sender.
+	// If Confirm is nil, destination-block requests are not handled.
+	Confirm IQueue
+	QueueName string
+	Address string
+	
+	// How long a nonce is valid. Zero means 48 hours. No further
+	// confirmation request is sent to an address during this time.
+	ConfirmTimeout time.Duration
+}
+
+var _ cypherpunk.RequestFilter = (*BlockList)(nil)
+
+/*
+Normalizes an address: the display name and angle brackets are removed and
+the address is lower-cased.
+*/
+func normalizeAddress(addr string) string {
+	if a,err := mail.ParseAddress(addr); err==nil { addr = a.Address }
+	return strings.ToLower(strings.Trim(strings.TrimSpace(addr),"<>"))
+}
+
+func (b *BlockList) put(key string) error {
+	return b.DB.Batch(func(tx *bolt.Tx) error {
+		bkt,err := tx.CreateBucketIfNotExists(bBlockList)
+		if err!=nil { return err }
+		return bkt.Put([]byte(key),[]byte{1})
+	})
+}
+
+func (b *BlockList) BlockAddress(addr string) error { return b.put("a:"+normalizeAddress(addr)) }
+func (b *BlockList) BlockDomain(domain string) error { return b.put("d:"+strings.ToLower(domain)) }
+func (b *BlockList) BlockRegexp(expr string) error {
+	_,err := regexp.Compile(expr)
+	if err!=nil { return err }
+	return b.put("r:"+expr)
+}
+
+/*
+Removes an address, domain or regular expression from the block list.
+*/
+func (b *BlockList) Unblock(entry string) error {
+	return b.DB.Batch(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bBlockList)
+		if bkt==nil { return nil }
+		for _,k := range []string{"a:"+normalizeAddress(entry),"d:"+strings.ToLower(entry),"r:"+entry} {
+			err := bkt.Delete([]byte(k))
+			if err!=nil { return err }
+		}
+		return nil
+	})
+}
+
+func blocked(bkt *bolt.Bucket, addr string) bool {
+	addr = normalizeAddress(addr)
+	if bkt.Get([]byte("a:"+addr))!=nil { return true }
+	if i := strings.LastIndexByte(addr,'@'); i>=0 {
+		// The domain and its parent domains.
+		for d := addr[i+1:]; d!=""; {
+			if bkt.Get([]byte("d:"+d))!=nil { return true }
+			j := strings.IndexByte(d,'.')
+			if j<0 { break }
+			d = d[j+1:]
+		}
+	}
+	c := bkt.Cursor()
+	prefix := []byte("r:")
+	for k,_ := c.Seek(prefix); bytes.HasPrefix(k,prefix); k,_ = c.Next() {
+		re,err := regexp.Compile(string(k[2:]))
+		if err==nil && re.MatchString(addr) { return true }
+	}
+	return false
+}
+
+/*
+Reports, whether an address is blocked.
+*/
+func (b *BlockList) Blocked(addr string) (res bool,err error) {
+	err = b.DB.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bBlockList)
+		if bkt!=nil { res = blocked(bkt,addr) }
+		return nil
+	})
+	return
+}
+
+/*
+Returns the number of recipients that have been dropped.
+*/
+func (b *BlockList) Dropped() (n uint64) {
+	b.DB.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bBlockList)
+		if bkt==nil { return nil }
+		if v := bkt.Get(kBlockedCount); len(v)==8 { n = binary.BigEndian.Uint64(v) }
+		return nil
+	})
+	return
+}
+
+/*
+Removes the blocked recipients from the message. If neither a recipient nor a
+newsgroup is left, the message is dropped (EDropped).
+*/
+func (b *BlockList) Filter(qmsg *qmodel.Message) error {
+	if len(qmsg.To)==0 { return nil }
+	var to []string
+	err := b.DB.Batch(func(tx *bolt.Tx) error {
+		to = to[:0]
+		bkt,err := tx.CreateBucketIfNotExists(bBlockList)
+		if err!=nil { return err }
+		for _,rcpt := range qmsg.To {
+			if !blocked(bkt,rcpt) { to = append(to,rcpt) }
+		}
+		n := len(qmsg.To)-len(to)
+		if n==0 { return nil }
+		var v [8]byte
+		if old := bkt.Get(kBlockedCount); len(old)==8 { copy(v[:],old) }
+		binary.BigEndian.PutUint64(v[:],binary.BigEndian.Uint64(v[:])+uint64(n))
+		return bkt.Put(kBlockedCount,v[:])
+	})
+	if err!=nil { return err }
+	qmsg.To = to
+	if len(to)==0 && len(qmsg.Newsgroups)==0 { return EDropped }
+	return nil
+}
+
+func (b *BlockList) timeout() time.Duration {
+	if b.ConfirmTimeout<=0 { return 48*time.Hour }
+	return b.ConfirmTimeout
+}
+
+/*
+Parses the subject of a block request. Reply prefixes are ignored.
+*/
+func parseBlockSubject(subject string) (ok bool,nonce string) {
+	f := strings.Fields(subject)
+	for len(f)>0 && strings.EqualFold(f[0],"Re:") { f = f[1:] }
+	if len(f)==0 || len(f)>2 || !strings.EqualFold(f[0],"destination-block") { return }
+	if len(f)==2 { nonce = strings.ToLower(f[1]) }
+	return true,nonce
+}
+
+/*
+Handles "destination-block" requests. A request without nonce causes a
+confirmation request to be sent to the sender. A request with a valid nonce
+adds the address the nonce was sent to to the block list.
+*/
+func (b *BlockList) Request(msg []byte) (handled bool,err error) {
+	if b.Confirm==nil { return false,nil }
+	h,err := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg))).ReadMIMEHeader()
+	if err!=nil && len(h)==0 { return false,nil }
+	ok,nonce := parseBlockSubject(h.Get("Subject"))
+	if !ok { return false,nil }
+	if nonce!="" { return true,b.confirm(nonce) }
+	from := normalizeAddress(h.Get("From"))
+	if from=="" { return true,nil }
+	return true,b.requestConfirmation(from)
+}
+
+/*
+Blocks the address, a nonce was sent to. Unknown and expired nonces are
+ignored.
+*/
+func (b *BlockList) confirm(nonce string) error {
+	now := time.Now()
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(bBlockPending)
+		if pending==nil { return nil }
+		v := pending.Get([]byte("n:"+nonce))
+		if len(v)<8 { return nil }
+		addr := string(v[8:])
+		if now.After(time.Unix(0,int64(binary.BigEndian.Uint64(v)))) { return nil }
+		err := pending.Delete([]byte("n:"+nonce))
+		if err!=nil { return err }
+		err = pending.Delete([]byte("a:"+addr))
+		if err!=nil { return err }
+		bkt,err := tx.CreateBucketIfNotExists(bBlockList)
+		if err!=nil { return err }
+		return bkt.Put([]byte("a:"+addr),[]byte{1})
+	})
+}
+
+/*
+Records a nonce for the address and enqueues the confirmation request. At
+most one request per timeout is sent to an address, so that the remailer
+can not be used to flood it.
+*/
+func (b *BlockList) requestConfirmation(addr string) error {
+	var nb [16]byte
+	_,err := rand.Read(nb[:])
+	if err!=nil { return err }
+	nonce := hex.EncodeToString(nb[:])
+	now := time.Now()
+	expires := now.Add(b.timeout())
+	send := false
+	err = b.DB.Update(func(tx *bolt.Tx) error {
+		pending,err := tx.CreateBucketIfNotExists(bBlockPending)
+		if err!=nil { return err }
+		
+		// Forget the expired nonces.
+		var expired [][]byte
+		c := pending.Cursor()
+		prefix := []byte("n:")
+		for k,v := c.Seek(prefix); bytes.HasPrefix(k,prefix); k,v = c.Next() {
+			if len(v)<8 || now.After(time.Unix(0,int64(binary.BigEndian.Uint64(v)))) {
+				expired = append(expired,append([]byte(nil),k...))
+				if len(v)>=8 { expired = append(expired,append([]byte("a:"),v[8:]...)) }
+			}
+		}
+		for _,k := range expired {
+			err = pending.Delete(k)
+			if err!=nil { return err }
+		}
+		if pending.Get([]byte("a:"+addr))!=nil { return nil }
+		
+		v := make([]byte,8,8+len(addr))
+		binary.BigEndian.PutUint64(v,uint64(expires.UnixNano()))
+		err = pending.Put([]byte("n:"+nonce),append(v,addr...))
+		if err!=nil { return err }
+		send = true
+		return pending.Put([]byte("a:"+addr),[]byte(nonce))
+	})
+	if err!=nil || !send { return err }
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: destination-block %s\r\n\r\n"+
+		"Somebody, possibly you, asked this remailer to never send mail to\r\n"+
+		"%s again.\r\n\r\n"+
+		"To confirm, reply to this message without changing the subject\r\n"+
+		"before %s. Otherwise, ignore this message.\r\n",
+		b.Address,addr,nonce,addr,expires.UTC().Format(time.RFC1123Z))
+	return b.Confirm.EnqueueMessage(b.QueueName,&qmodel.Message{From:b.Address,To:[]string{addr},Body:[]byte(body)})
+}
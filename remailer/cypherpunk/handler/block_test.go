@@ -0,0 +1,61 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package handler
+
+import "github.com/a-mail-group/ampp/qmodel"
+import "regexp"
+import "testing"
+import "time"
+
+func TestBlockRequest(t *testing.T) {
+	_,q,cleanup := tempQueue(t,"block")
+	defer cleanup()
+	b := &BlockList{DB:q.DB,Confirm:q,QueueName:"out",Address:"remailer@example.org"}
+	request := func(from,subject string) {
+		handled,err := b.Request([]byte("From: "+from+"\r\nSubject: "+subject+"\r\n\r\n"))
+		if err!=nil || !handled { t.Fatalf("%q not handled: %v",subject,err) }
+	}
+	isBlocked := func(addr string) bool {
+		res,err := b.Blocked(addr)
+		if err!=nil { t.Fatal(err) }
+		return res
+	}
+	
+	// A forged request only sends a confirmation request, once.
+	request("Victim <victim@example.org>","destination-block")
+	request("victim@example.org","destination-block")
+	if isBlocked("victim@example.org") { t.Fatal("blocked without confirmation") }
+	l,err := q.Lease("out",10,time.Hour)
+	if err!=nil || len(l)!=1 { t.Fatal("confirmation requests:",len(l),err) }
+	if l[0].Msg.To[0]!="victim@example.org" { t.Fatal(l[0].Msg.To) }
+	m := regexp.MustCompile(`Subject: destination-block ([0-9a-f]+)\r\n`).FindSubmatch(l[0].Msg.Body)
+	if m==nil { t.Fatalf("no nonce in %q",l[0].Msg.Body) }
+	
+	request("attacker@example.org","destination-block 00112233445566778899aabbccddeeff")
+	if isBlocked("victim@example.org") || isBlocked("attacker@example.org") { t.Fatal("blocked with a wrong nonce") }
+	
+	// The reply to the confirmation request.
+	request("victim@example.org","Re: destination-block "+string(m[1]))
+	if !isBlocked("victim@example.org") { t.Fatal("not blocked after confirmation") }
+	
+	msg := &qmodel.Message{To:[]string{"victim@example.org","other@example.org"}}
+	err = b.Filter(msg)
+	if err!=nil || len(msg.To)!=1 || msg.To[0]!="other@example.org" { t.Fatal(msg.To,err) }
+	if b.Dropped()!=1 { t.Fatal("dropped",b.Dropped()) }
+	err = b.Filter(&qmodel.Message{To:[]string{"victim@example.org"}})
+	if err!=EDropped { t.Fatal("message to blocked recipient:",err) }
+	
+	// News articles have no mail recipients.
+	err = b.Filter(&qmodel.Message{Newsgroups:[]string{"alt.test"}})
+	if err!=nil { t.Fatal("news article:",err) }
+	
+	// Other messages are not handled.
+	handled,err := b.Request([]byte("From: a@example.org\r\nSubject: hello\r\n\r\n"))
+	if handled || err!=nil { t.Fatal(handled,err) }
+}
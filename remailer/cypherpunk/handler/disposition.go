@@ -0,0 +1,178 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+
+package handler
+
+import "github.com/a-mail-group/ampp/remailer/cypherpunk"
+import "github.com/a-mail-group/ampp/crypto/boxpgp"
+import bolt "github.com/coreos/bbolt"
+import "github.com/vmihailenco/msgpack"
+import "net/textproto"
+import "time"
+
+/*
+The class of an error that occurred while processing an inbound message.
+*/
+type ErrorClass int
+const (
+	// cypherpunk.ENotRemail
+	CNotRemail ErrorClass = iota
+
+	// cypherpunk.EInvalidArmor
+	CInvalidArmor
+
+	// cypherpunk.EUnknownEncryption
+	CUnknownEncryption
+
+	// boxpgp.IsKeyError()
+	CKey
+
+	// Malformed messages and OpenPGP packets.
+	CStructural
+
+	// Any other error, including failures to enqueue the message and
+	// ERateLimited.
+	CTransient
+
+	// EDropped, ETooLarge, ETooManyRecipients: the message was handled or
+	// rejected by a filter. Deleted by default.
+	CDropped
+)
+
+var classNames = [...]string{"not-remail","invalid-armor","unknown-encryption","key","structural","transient","dropped"}
+
+func (c ErrorClass) String() string {
+	if c<0 || int(c)>=len(classNames) { return "unknown" }
+	return classNames[c]
+}
+
+/*
+Classifies an error returned by cypherpunk.ProcessMessage().
+*/
+func Classify(err error) ErrorClass {
+	switch err {
+	case cypherpunk.ENotRemail: return CNotRemail
+	case cypherpunk.EInvalidArmor: return CInvalidArmor
+	case cypherpunk.EUnknownEncryption: return CUnknownEncryption
+	case cypherpunk.EBadNewsgroup,cypherpunk.EBadEncryptTo: return CStructural
+	case EDropped,ETooLarge,ETooManyRecipients: return CDropped
+	}
+	if _,ok := err.(textproto.ProtocolError); ok { return CStructural }
+	switch {
+	case boxpgp.IsKeyError(err): return CKey
+	case boxpgp.IsStructuralError(err): return CStructural
+	}
+	return CTransient
+}
+
+type Action int
+const (
+	// Leave the message in place. Transient failures are retried.
+	Leave Action = iota
+
+	// Delete the message.
+	Delete
+
+	// Move the message into Disposition.Folder.
+	Move
+
+	// Record the message in the quarantine bucket, then delete it.
+	Quarantine
+)
+
+/*
+What to do with a message that could not be processed.
+*/
+type Disposition struct{
+	Action Action
+	Folder string // For Move.
+}
+
+/*
+Dispositions by error class. Classes not in the map are left in place,
+unless delInv is set and the class is not CTransient. CDropped is deleted.
+*/
+type Dispositions map[ErrorClass]Disposition
+
+func (d Dispositions) get(c ErrorClass, delInv bool) Disposition {
+	if r,ok := d[c]; ok { return r }
+	if (delInv && c!=CTransient) || c==CDropped { return Disposition{Action:Delete} }
+	return Disposition{Action:Leave}
+}
+
+/*
+Returns the disposition of a message, that failed with err, and the class of
+err. A message to be quarantined is left in place if db is nil, or as a
+transient failure if it could not be recorded.
+*/
+func (d Dispositions) decide(db *bolt.DB, source string, err error, data []byte, delInv bool) (Disposition,ErrorClass) {
+	class := Classify(err)
+	r := d.get(class,delInv)
+	if r.Action!=Quarantine { return r,class }
+	if db==nil { return Disposition{Action:Leave},class }
+	if QuarantineMessage(db,&QuarantineRecord{source,class,err.Error(),time.Now(),data})!=nil {
+		return Disposition{Action:Leave},CTransient
+	}
+	return r,class
+}
+
+var bQuarantine = []byte("quarantine")
+
+/*
+A message recorded in the quarantine bucket.
+*/
+type QuarantineRecord struct{
+	Source string // The idempotency key of the source message.
+	Class ErrorClass
+	Reason string
+	Time time.Time
+	Message []byte
+}
+
+/*
+Records a rejected message in the quarantine bucket.
+*/
+func QuarantineMessage(db *bolt.DB, rec *QuarantineRecord) error {
+	data,err := msgpack.Marshal(rec)
+	if err!=nil { return err }
+	key := make([]byte,0,len(time.RFC3339Nano))
+	key = time.Now().UTC().AppendFormat(key,time.RFC3339Nano)
+	return db.Batch(func(tx *bolt.Tx) error {
+		bkt,err := tx.CreateBucketIfNotExists(bQuarantine)
+		if err!=nil { return err }
+		return bkt.Put(key,data)
+	})
+}
+
+/*
+Iterates over the quarantined messages, for review.
+*/
+func ListQuarantine(db *bolt.DB, f func(key []byte, rec *QuarantineRecord) error) error {
+	return db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bQuarantine)
+		if bkt==nil { return nil }
+		return bkt.ForEach(func(k,v []byte) error {
+			rec := new(QuarantineRecord)
+			err := msgpack.Unmarshal(v,rec)
+			if err!=nil { return err }
+			return f(k,rec)
+		})
+	})
+}
+
+/*
+Removes a message from the quarantine bucket.
+*/
+func RemoveQuarantined(db *bolt.DB, key []byte) error {
+	return db.Batch(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bQuarantine)
+		if bkt==nil { return nil }
+		return bkt.Delete(key)
+	})
+}
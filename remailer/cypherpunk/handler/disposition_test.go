@@ -0,0 +1,68 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package handler
+
+import "github.com/a-mail-group/ampp/remailer/cypherpunk"
+import pgperrs "golang.org/x/crypto/openpgp/errors"
+import "errors"
+import "io"
+import "testing"
+
+func TestClassify(t *testing.T) {
+	for _,c := range []struct{ err error; class ErrorClass }{
+		{cypherpunk.ENotRemail,CNotRemail},
+		{cypherpunk.EInvalidArmor,CInvalidArmor},
+		{cypherpunk.EUnknownEncryption,CUnknownEncryption},
+		{cypherpunk.EBadEncryptTo,CStructural},
+		{pgperrs.ErrKeyIncorrect,CKey},
+		{pgperrs.StructuralError("broken"),CStructural},
+		{io.ErrUnexpectedEOF,CStructural},
+		{EDropped,CDropped},
+		{ETooLarge,CDropped},
+		{ERateLimited,CTransient},
+		{errors.New("disk full"),CTransient},
+	} {
+		if class := Classify(c.err); class!=c.class { t.Errorf("%v: %v, want %v",c.err,class,c.class) }
+	}
+}
+
+func TestDispositions(t *testing.T) {
+	d := Dispositions{CKey:{Action:Move,Folder:"Keys"},CNotRemail:{Action:Quarantine}}
+	for _,c := range []struct{ class ErrorClass; delInv bool; action Action }{
+		{CKey,false,Move},
+		{CStructural,false,Leave},
+		{CStructural,true,Delete},
+		{CTransient,true,Leave},
+		{CDropped,false,Delete},
+	} {
+		if r := d.get(c.class,c.delInv); r.Action!=c.action { t.Errorf("%v, delInv %v: %v, want %v",c.class,c.delInv,r.Action,c.action) }
+	}
+	
+	// Without a database, a message to be quarantined is left in place.
+	r,class := d.decide(nil,"src",cypherpunk.ENotRemail,nil,true)
+	if r.Action!=Leave || class!=CNotRemail { t.Fatal("no database:",r,class) }
+	
+	dir,_,cleanup := tempQueue(t,"quarantine")
+	defer cleanup()
+	db := tempDB(t,dir,"state.db")
+	r,class = d.decide(db,"src",cypherpunk.ENotRemail,[]byte("data"),false)
+	if r.Action!=Quarantine || class!=CNotRemail { t.Fatal(r,class) }
+	var recs []*QuarantineRecord
+	err := ListQuarantine(db,func(key []byte,rec *QuarantineRecord) error {
+		recs = append(recs,rec)
+		return nil
+	})
+	if err!=nil { t.Fatal(err) }
+	if len(recs)!=1 || recs[0].Source!="src" || string(recs[0].Message)!="data" { t.Fatalf("quarantine %v",recs) }
+	
+	// If it can not be recorded, it is retried.
+	db.Close()
+	r,class = d.decide(db,"src",cypherpunk.ENotRemail,nil,false)
+	if r.Action!=Leave || class!=CTransient { t.Fatal("closed database:",r,class) }
+}
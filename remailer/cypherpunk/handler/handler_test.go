@@ -0,0 +1,55 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package handler
+
+import "github.com/a-mail-group/ampp/queue"
+import bolt "github.com/coreos/bbolt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+func remailMessage(to string) string {
+	return "From: sender@example.org\r\nSubject: remail\r\n\r\n::\r\nAnon-To: "+to+"\r\n\r\n##\r\nSubject: hello\r\n\r\nbody\r\n"
+}
+
+/*
+Opens a queue in a new temporary directory. The cleanup function closes the
+queue and removes the directory.
+*/
+func tempQueue(t *testing.T,prefix string) (dir string,q *queue.Queue,cleanup func()) {
+	dir,err := ioutil.TempDir("",prefix)
+	if err!=nil { t.Fatal(err) }
+	q,err = queue.Open(filepath.Join(dir,"queue.db"))
+	if err!=nil { os.RemoveAll(dir); t.Fatal(err) }
+	cleanup = func() {
+		q.Close()
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+func tempDB(t *testing.T,dir,name string) *bolt.DB {
+	db,err := bolt.Open(filepath.Join(dir,name),0600,nil)
+	if err!=nil { t.Fatal(err) }
+	return db
+}
+
+func countQueue(t *testing.T,q *queue.Queue,name string) (n int) {
+	err := q.Process(func(tx *queue.Tx) error {
+		f := tx.Fetch(name)
+		for {
+			_,_,err := f.Next()
+			if err!=nil { return nil }
+			n++
+		}
+	})
+	if err!=nil { t.Fatal(err) }
+	return
+}
@@ -14,70 +14,314 @@ import "golang.org/x/crypto/openpgp"
 import "github.com/emersion/go-imap"
 import "github.com/emersion/go-imap/client"
 import "io/ioutil"
-import "github.com/emersion/go-message"
-import pgperrs "golang.org/x/crypto/openpgp/errors"
+import "github.com/a-mail-group/ampp/imapio"
+import bolt "github.com/coreos/bbolt"
+import "encoding/binary"
+import "time"
+import "fmt"
+import "math"
+
+var bImapState = []byte("imap-state")
 
 type ImapWaiter struct{
 	Conn *client.Client
 	Ring openpgp.KeyRing
 	Mailbox, Address string
+	
+	// Applied to the messages before they are enqueued.
+	Filters []cypherpunk.Filter
+	
+	// Deletes invalid messages, unless Dispositions says otherwise.
 	DelInv bool
+	Dispositions Dispositions
+	
 	Target IQueue
 	QueueName string
+	
+	// If not empty, processed messages are moved into this mailbox instead of
+	// being deleted.
+	Processed string
+	
+	// Used by Run() to (re-)connect. Optional for Process().
+	Connector *imapio.Connector
+	
+	// If not nil, the UIDVALIDITY and the next UID to be processed are
+	// persisted in this database, so that only new messages are fetched
+	// after a restart. Also holds the quarantine bucket.
+	State *bolt.DB
+	
+	// Poll interval for servers without IDLE. Zero means the default.
+	PollInterval time.Duration
+	
+	// Maximum delay between reconnection attempts. Zero means 5 minutes.
+	MaxBackoff time.Duration
+	
+	// Delay after which Run() retries messages that failed transiently (for
+	// example because of a rate limit). Zero means 1 minute.
+	RetryInterval time.Duration
+	
+	// How long the idempotency keys of enqueued messages are kept. Zero means
+	// DefaultIdRetention.
+	IdRetention time.Duration
+	
+	uidValidity, uidNext uint32
+	pending bool
+	ids idExpiry
+}
+
+func (i *ImapWaiter) stateKey() []byte {
+	return []byte(i.Address+"\x00"+i.Mailbox)
+}
+
+/*
+The idempotency key of a message, in the style of an IMAP URL (RFC 5092).
+*/
+func (i *ImapWaiter) sourceId(uid uint32) []byte {
+	return []byte(fmt.Sprintf("imap:%s/%s;UIDVALIDITY=%d/;UID=%d",i.Address,i.Mailbox,i.uidValidity,uid))
+}
+
+func (i *ImapWaiter) loadState() {
+	if i.State==nil { return }
+	i.State.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bImapState)
+		if bkt==nil { return nil }
+		v := bkt.Get(i.stateKey())
+		if len(v)!=8 { return nil }
+		i.uidValidity = binary.BigEndian.Uint32(v)
+		i.uidNext = binary.BigEndian.Uint32(v[4:])
+		return nil
+	})
+}
+
+func (i *ImapWaiter) saveState() error {
+	if i.State==nil { return nil }
+	var v [8]byte
+	binary.BigEndian.PutUint32(v[:],i.uidValidity)
+	binary.BigEndian.PutUint32(v[4:],i.uidNext)
+	return i.State.Batch(func(tx *bolt.Tx) error {
+		bkt,err := tx.CreateBucketIfNotExists(bImapState)
+		if err!=nil { return err }
+		return bkt.Put(i.stateKey(),v[:])
+	})
 }
+
+/*
+Fetches and processes the messages that arrived since the last call.
+*/
 func (i *ImapWaiter) Process() error {
-	mbox,err := i.Conn.Select(i.Mailbox, false)
-	if err!=nil { return err }
+	// Selecting the mailbox again would trigger an EXISTS response, so an
+	// already selected mailbox is reused.
+	var err error
+	mbox := i.Conn.Mailbox()
+	if mbox==nil || mbox.Name!=i.Mailbox || mbox.ReadOnly {
+		mbox,err = i.Conn.Select(i.Mailbox, false)
+		if err!=nil { return err }
+		if i.uidValidity==0 { i.loadState() }
+		if i.uidValidity!=mbox.UidValidity {
+			// The UIDs are no longer valid, start over.
+			i.uidValidity = mbox.UidValidity
+			i.uidNext = 1
+		}
+		if mbox.Messages==0 || (mbox.UidNext!=0 && i.uidNext>=mbox.UidNext) { return nil }
+	}
+	if i.uidNext==0 { i.uidNext = 1 }
+	
 	seqset := new(imap.SeqSet)
-	seqset.AddRange(1,mbox.Messages)
+	seqset.AddRange(i.uidNext,0)
 	
+	// The UIDs of the messages to be removed from the mailbox.
 	delset := new(imap.SeqSet)
+	moves := make(moveSets)
+	
+	// The lowest UID that failed transiently. Processing resumes there.
+	var failed uint32
+	next := i.uidNext
 	
 	messages := make(chan *imap.Message, 1024)
 	done := make(chan error, 1)
 	go func() {
-		done <- i.Conn.Fetch(seqset, []imap.FetchItem{imap.FetchRFC822}, messages)
+		done <- i.Conn.UidFetch(seqset, []imap.FetchItem{imap.FetchUid,imap.FetchFlags,imap.FetchRFC822}, messages)
 	}()
 	
 	for msg := range messages {
+		// "n:*" always includes the last message, even if its UID is below n.
+		if msg.Uid<i.uidNext { continue }
+		if msg.Uid>=next { next = msg.Uid+1 }
+		if deleted(msg) { continue } // Removed without UIDPLUS, or by another client.
 		var body imap.Literal
 		for k,v := range msg.Body {
 			if k.FetchItem()==imap.FetchRFC822 { body = v }
 		}
 		if body==nil { continue }
-		ent,err := message.Read(body)
-		if err!=nil { continue }
-		data,err := ioutil.ReadAll(ent.Body)
+		data,err := ioutil.ReadAll(body)
 		if err!=nil { continue }
-		qmsg,err := cypherpunk.ProcessMessage(data,i.Address,i.Ring)
-		if err!=nil {
-			if err==cypherpunk.ENotRemail || err==cypherpunk.EInvalidArmor || err==cypherpunk.EUnknownEncryption {
-				if i.DelInv { delset.AddRange(msg.SeqNum,msg.SeqNum) }
-				continue
-			}
-			if err==pgperrs.ErrKeyIncorrect || err==pgperrs.ErrKeyRevoked || err==pgperrs.ErrUnknownIssuer {
-				if i.DelInv { delset.AddRange(msg.SeqNum,msg.SeqNum) }
+		qmsg,err := processMessage(data,i.Address,i.Ring,i.Filters)
+		if err==nil {
+			_,err = i.Target.EnqueueMessageOnce(i.QueueName,i.sourceId(msg.Uid),qmsg)
+			if err==nil {
+				if i.Processed!="" {
+					moves.add(i.Processed,msg.Uid)
+				} else {
+					delset.AddNum(msg.Uid)
+				}
 				continue
 			}
-			switch err.(type) {
-			case	pgperrs.InvalidArgumentError,
-				pgperrs.SignatureError,
-				pgperrs.StructuralError,
-				pgperrs.UnknownPacketTypeError,
-				pgperrs.UnsupportedError:
-				if i.DelInv { delset.AddRange(msg.SeqNum,msg.SeqNum) }
-				continue
+		}
+		d,class := i.Dispositions.decide(i.State,string(i.sourceId(msg.Uid)),err,data,i.DelInv)
+		switch d.Action {
+		case Leave:
+			if class==CTransient && (failed==0 || msg.Uid<failed) { failed = msg.Uid }
+		case Move:
+			moves.add(d.Folder,msg.Uid)
+		default:
+			delset.AddNum(msg.Uid)
+		}
+	}
+	err = <-done
+	i.ids.expire(i.Target,i.QueueName,i.IdRetention)
+	i.pending = failed!=0
+	if failed!=0 { next = failed }
+	
+	// The messages handled before a failed fetch are still disposed of. If that
+	// fails, processing resumes at the first message that was not.
+	for folder,set := range moves {
+		e := imapio.MoveUids(i.Conn,set,folder)
+		if e==nil { continue }
+		if err==nil { err = e }
+		if u := minUid(set); u<next { next = u }
+	}
+	_,e := imapio.DeleteUids(i.Conn,delset)
+	if e!=nil {
+		if err==nil { err = e }
+		if u := minUid(delset); u<next { next = u }
+	}
+	if next>i.uidNext {
+		i.uidNext = next
+		e = i.saveState()
+		if err==nil { err = e }
+	}
+	return err
+}
+
+// The lowest UID in a set, or MaxUint32 if it is empty.
+func minUid(set *imap.SeqSet) uint32 {
+	uid := uint32(math.MaxUint32)
+	for _,s := range set.Set {
+		if s.Start<uid { uid = s.Start }
+	}
+	return uid
+}
+
+// UID sets by destination mailbox.
+type moveSets map[string]*imap.SeqSet
+func (m moveSets) add(folder string,uid uint32) {
+	set,ok := m[folder]
+	if !ok { set = new(imap.SeqSet); m[folder] = set }
+	set.AddNum(uid)
+}
+
+func deleted(msg *imap.Message) bool {
+	for _,f := range msg.Flags {
+		if f==imap.DeletedFlag { return true }
+	}
+	return false
+}
+
+func (i *ImapWaiter) disconnect() {
+	if i.Conn==nil { return }
+	i.Conn.Logout()
+	i.Conn = nil
+}
+
+/*
+Processes the mailbox until stop is closed. It waits for new messages using
+IMAP IDLE (or NOOP polling, if IDLE is not supported) and reconnects with
+exponential backoff if the connection is lost. Requires Connector. A
+connection in Conn is closed first, since Run() needs its own Updates channel.
+*/
+func (i *ImapWaiter) Run(stop <-chan struct{}) error {
+	if i.Connector==nil { return EBadConfig }
+	maxBackoff := i.MaxBackoff
+	if maxBackoff<=0 { maxBackoff = 5*time.Minute }
+	backoff := time.Duration(0)
+	
+	// The updates of all connections wake up idleLoop(). The client blocks on
+	// Updates, so it is drained until all connections are closed.
+	wake := make(chan struct{},1)
+	updates := make(chan client.Update,16)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case u := <-updates:
+				if _,ok := u.(*client.MailboxUpdate); !ok { continue }
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			case <-done:
+				return
 			}
-			continue
 		}
-		err = i.Target.EnqueueMessage(i.QueueName,qmsg)
-		if err==nil {
-			delset.AddRange(msg.SeqNum,msg.SeqNum)
+	}()
+	
+	i.disconnect()
+	defer i.disconnect()
+	for {
+		if backoff>0 {
+			select {
+			case <-stop: return nil
+			case <-time.After(backoff):
+			}
 		}
+		var err error
+		i.Conn,err = i.Connector.ConnectUpdates(updates)
+		if err==nil { err = i.idleLoop(stop,wake) }
+		if err==nil { return nil } // Stopped.
+		i.disconnect()
+		backoff *= 2
+		if backoff==0 { backoff = time.Second }
+		if backoff>maxBackoff { backoff = maxBackoff }
 	}
-	<-done
-	i.Conn.Store(delset,imap.FormatFlagsOp(imap.AddFlags, true),[]interface{}{imap.SeenFlag},nil)
-	i.Conn.Expunge(nil)
-	return nil
 }
 
+/*
+Processes new messages whenever the server announces them. Returns nil if
+stop was closed.
+*/
+func (i *ImapWaiter) idleLoop(stop <-chan struct{},wake <-chan struct{}) error {
+	conn := i.Conn
+	opts := &client.IdleOptions{PollInterval:i.PollInterval}
+	retryInterval := i.RetryInterval
+	if retryInterval<=0 { retryInterval = time.Minute }
+	for {
+		err := i.Process()
+		if err!=nil { return err }
+		select {
+		case <-wake: // Caused by our own commands.
+		default:
+		}
+		
+		idleStop := make(chan struct{})
+		idleDone := make(chan error,1)
+		go func() { idleDone <- conn.Idle(idleStop,opts) }()
+		var retry <-chan time.Time
+		if i.pending { retry = time.After(retryInterval) }
+		select {
+		case <-stop:
+			close(idleStop)
+			<-idleDone
+			return nil
+		case <-wake:
+			close(idleStop)
+			err = <-idleDone
+		case <-retry:
+			close(idleStop)
+			err = <-idleDone
+		case err = <-idleDone:
+			if err==nil { err = client.ErrNotLoggedIn } // Idle ended by itself.
+		}
+		if err!=nil { return err }
+	}
+}
@@ -0,0 +1,182 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package handler
+
+import "github.com/a-mail-group/ampp/imapio"
+import "github.com/a-mail-group/ampp/queue"
+import "github.com/emersion/go-imap"
+import "github.com/emersion/go-imap/backend"
+import "github.com/emersion/go-imap/backend/memory"
+import "github.com/emersion/go-imap/server"
+import "golang.org/x/crypto/openpgp"
+import "bytes"
+import "net"
+import "sync/atomic"
+import "testing"
+import "time"
+
+/*
+The memory backend of go-imap, with a settable UIDVALIDITY and updates, that
+are sent to IDLE clients.
+*/
+type imapBackend struct{
+	*memory.Backend
+	updates chan backend.Update
+	validity uint32
+}
+
+func (b *imapBackend) Updates() <-chan backend.Update { return b.updates }
+
+func (b *imapBackend) Login(ci *imap.ConnInfo,username,password string) (backend.User,error) {
+	u,err := b.Backend.Login(ci,username,password)
+	if err!=nil { return nil,err }
+	return &imapUser{u,b},nil
+}
+
+type imapUser struct{
+	backend.User
+	b *imapBackend
+}
+
+func (u *imapUser) GetMailbox(name string) (backend.Mailbox,error) {
+	m,err := u.User.GetMailbox(name)
+	if err!=nil { return nil,err }
+	return &imapMailbox{m,u.b},nil
+}
+
+type imapMailbox struct{
+	backend.Mailbox
+	b *imapBackend
+}
+
+func (m *imapMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus,error) {
+	s,err := m.Mailbox.Status(items)
+	if err!=nil { return nil,err }
+	if _,ok := s.Items[imap.StatusUidValidity]; ok { s.UidValidity = atomic.LoadUint32(&m.b.validity) }
+	return s,nil
+}
+
+func newImapServer(t *testing.T) (*imapBackend,net.Listener) {
+	b := &imapBackend{Backend:memory.New(),updates:make(chan backend.Update,16),validity:1}
+	s := server.New(b)
+	s.AllowInsecureAuth = true
+	l,err := net.Listen("tcp","127.0.0.1:0")
+	if err!=nil { t.Fatal(err) }
+	go s.Serve(l)
+	return b,l
+}
+
+func (b *imapBackend) inbox(t *testing.T) *memory.Mailbox {
+	u,err := b.Backend.Login(nil,"username","password")
+	if err!=nil { t.Fatal(err) }
+	m,err := u.GetMailbox("INBOX")
+	if err!=nil { t.Fatal(err) }
+	return m.(*memory.Mailbox)
+}
+
+func (b *imapBackend) create(t *testing.T,data string) *memory.Mailbox {
+	m := b.inbox(t)
+	err := m.CreateMessage(nil,time.Now(),bytes.NewReader([]byte(data)))
+	if err!=nil { t.Fatal(err) }
+	return m
+}
+
+/*
+Delivers a message and announces it to IDLE clients.
+*/
+func (b *imapBackend) deliver(t *testing.T,data string) {
+	m := b.create(t,data)
+	status,err := m.Status([]imap.StatusItem{imap.StatusMessages})
+	if err!=nil { t.Fatal(err) }
+	b.updates <- &backend.MailboxUpdate{Update:backend.NewUpdate("username","INBOX"),MailboxStatus:status}
+}
+
+func waitQueue(t *testing.T,q *queue.Queue,name string,n int) {
+	for deadline := time.Now().Add(5*time.Second); countQueue(t,q,name)!=n; {
+		if time.Now().After(deadline) { t.Fatalf("%d messages enqueued, want %d",countQueue(t,q,name),n) }
+		time.Sleep(10*time.Millisecond)
+	}
+}
+
+func TestImapWaiterRun(t *testing.T) {
+	dir,q,cleanup := tempQueue(t,"imap")
+	defer cleanup()
+	state := tempDB(t,dir,"state.db")
+	defer state.Close()
+	b,l := newImapServer(t)
+	defer l.Close()
+	
+	// The memory backend starts with a message, that is not a remailer message
+	// (UID 6).
+	b.create(t,remailMessage("a@example.org"))
+	newWaiter := func() *ImapWaiter {
+		return &ImapWaiter{
+			Connector: &imapio.Connector{Addr:l.Addr().String(),NoTLS:true,Username:"username",Password:"password"},
+			Ring: openpgp.EntityList{},
+			Mailbox: "INBOX",
+			Address: "remailer@example.org",
+			Target: q,
+			QueueName: "out",
+			State: state,
+		}
+	}
+	run := func(w *ImapWaiter) (stop func()) {
+		ch := make(chan struct{})
+		done := make(chan error,1)
+		go func() { done <- w.Run(ch) }()
+		return func() {
+			close(ch)
+			if err := <-done; err!=nil { t.Fatal(err) }
+		}
+	}
+	
+	w := newWaiter()
+	stop := run(w)
+	waitQueue(t,q,"out",1)
+	
+	// A new message wakes up IDLE.
+	b.deliver(t,remailMessage("b@example.org"))
+	waitQueue(t,q,"out",2)
+	stop()
+	if w.uidValidity!=1 || w.uidNext!=9 { t.Fatalf("UIDVALIDITY %d, UIDNEXT %d",w.uidValidity,w.uidNext) }
+	
+	// The mailbox is recreated with a new UIDVALIDITY, the UIDs start over.
+	b.inbox(t).Messages = nil
+	atomic.StoreUint32(&b.validity,2)
+	b.create(t,remailMessage("c@example.org"))
+	w = newWaiter()
+	stop = run(w)
+	waitQueue(t,q,"out",3)
+	stop()
+	if w.uidValidity!=2 || w.uidNext!=2 { t.Fatalf("UIDVALIDITY %d, UIDNEXT %d",w.uidValidity,w.uidNext) }
+}
+
+func TestImapState(t *testing.T) {
+	dir,_,cleanup := tempQueue(t,"imap")
+	defer cleanup()
+	state := tempDB(t,dir,"state.db")
+	defer state.Close()
+	
+	w := &ImapWaiter{Address:"remailer@example.org",Mailbox:"INBOX",State:state,uidValidity:7,uidNext:42}
+	if id := string(w.sourceId(41)); id!="imap:remailer@example.org/INBOX;UIDVALIDITY=7/;UID=41" { t.Fatal(id) }
+	err := w.saveState()
+	if err!=nil { t.Fatal(err) }
+	
+	// The state is kept per address and mailbox.
+	r := &ImapWaiter{Address:"remailer@example.org",Mailbox:"INBOX",State:state}
+	r.loadState()
+	if r.uidValidity!=7 || r.uidNext!=42 { t.Fatalf("UIDVALIDITY %d, UIDNEXT %d",r.uidValidity,r.uidNext) }
+	r = &ImapWaiter{Address:"remailer@example.org",Mailbox:"Other",State:state}
+	r.loadState()
+	if r.uidValidity!=0 || r.uidNext!=0 { t.Fatalf("other mailbox: UIDVALIDITY %d, UIDNEXT %d",r.uidValidity,r.uidNext) }
+	
+	// A new UIDVALIDITY gives new idempotency keys.
+	r = &ImapWaiter{Address:"remailer@example.org",Mailbox:"INBOX",uidValidity:8}
+	if string(r.sourceId(41))==string(w.sourceId(41)) { t.Fatal("same key after UIDVALIDITY change") }
+}
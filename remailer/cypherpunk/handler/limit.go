@@ -0,0 +1,124 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+
+package handler
+
+import "github.com/a-mail-group/ampp/remailer/cypherpunk"
+import "github.com/a-mail-group/ampp/qmodel"
+import bolt "github.com/coreos/bbolt"
+import "encoding/binary"
+import "errors"
+import "math"
+import "strings"
+import "time"
+
+var bRateLimit = []byte("ratelimit")
+
+var (
+	// The message exceeds a rate limit and is deferred.
+	ERateLimited = errors.New("Rate limit exceeded")
+
+	// The message exceeds a size or recipient limit and is dropped.
+	ETooLarge = errors.New("Message too large")
+	ETooManyRecipients = errors.New("Too many recipients")
+)
+
+/*
+A token bucket rate: Burst messages, refilled at Burst per Per.
+A zero Rate is unlimited.
+*/
+type Rate struct{
+	Burst int
+	Per time.Duration
+}
+
+/*
+Limits the messages leaving the remailer exit. Rate limits are token buckets
+per destination address and per destination domain, persisted in BoltDB.
+*/
+type Limiter struct{
+	DB *bolt.DB
+
+	AddressRate Rate
+	DomainRate Rate
+
+	// Zero means unlimited.
+	MaxSize int
+	MaxRecipients int
+}
+
+var _ cypherpunk.Filter = (*Limiter)(nil)
+
+type tokenBucket struct{
+	key []byte
+	rate Rate
+	tokens float64
+}
+
+/*
+Loads a bucket and refills it up to the current time.
+*/
+func loadBucket(bkt *bolt.Bucket, key string, rate Rate, now time.Time) *tokenBucket {
+	tb := &tokenBucket{[]byte(key),rate,float64(rate.Burst)}
+	v := bkt.Get(tb.key)
+	if len(v)!=16 { return tb }
+	tokens := math.Float64frombits(binary.BigEndian.Uint64(v))
+	last := time.Unix(0,int64(binary.BigEndian.Uint64(v[8:])))
+	tokens += now.Sub(last).Seconds()/rate.Per.Seconds()*float64(rate.Burst)
+	if tokens<tb.tokens { tb.tokens = tokens }
+	return tb
+}
+
+func (tb *tokenBucket) store(bkt *bolt.Bucket, now time.Time) error {
+	var v [16]byte
+	binary.BigEndian.PutUint64(v[:],math.Float64bits(tb.tokens))
+	binary.BigEndian.PutUint64(v[8:],uint64(now.UnixNano()))
+	return bkt.Put(tb.key,v[:])
+}
+
+/*
+Enforces the limits. Tokens are only taken if every bucket of every recipient
+has enough of them, so a deferred message does not consume the rate.
+*/
+func (l *Limiter) Filter(qmsg *qmodel.Message) error {
+	if l.MaxSize>0 && len(qmsg.Body)>l.MaxSize { return ETooLarge }
+	if l.MaxRecipients>0 && len(qmsg.To)>l.MaxRecipients { return ETooManyRecipients }
+	if l.AddressRate.Burst<=0 && l.DomainRate.Burst<=0 { return nil }
+	limited := false
+	err := l.DB.Batch(func(tx *bolt.Tx) error {
+		limited = false
+		bkt,err := tx.CreateBucketIfNotExists(bRateLimit)
+		if err!=nil { return err }
+		now := time.Now()
+		buckets := make(map[string]*tokenBucket)
+		take := func(key string, rate Rate) {
+			if rate.Burst<=0 || rate.Per<=0 { return }
+			tb,ok := buckets[key]
+			if !ok { tb = loadBucket(bkt,key,rate,now); buckets[key] = tb }
+			tb.tokens--
+			if tb.tokens<0 { limited = true }
+		}
+		for _,rcpt := range qmsg.To {
+			addr := normalizeAddress(rcpt)
+			take("a:"+addr,l.AddressRate)
+			if i := strings.LastIndexByte(addr,'@'); i>=0 {
+				take("d:"+addr[i+1:],l.DomainRate)
+			}
+		}
+		if limited { return nil }
+		for _,tb := range buckets {
+			err = tb.store(bkt,now)
+			if err!=nil { return err }
+		}
+		return nil
+	})
+	if err!=nil { return err }
+	if limited { return ERateLimited }
+	return nil
+}
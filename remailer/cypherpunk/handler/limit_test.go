@@ -0,0 +1,56 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package handler
+
+import "github.com/a-mail-group/ampp/qmodel"
+import bolt "github.com/coreos/bbolt"
+import "testing"
+import "time"
+
+func TestTokenBucketRefill(t *testing.T) {
+	dir,_,cleanup := tempQueue(t,"limit")
+	defer cleanup()
+	db := tempDB(t,dir,"limit.db")
+	defer db.Close()
+	rate := Rate{4,time.Hour}
+	now := time.Now()
+	err := db.Update(func(tx *bolt.Tx) error {
+		bkt,err := tx.CreateBucketIfNotExists(bRateLimit)
+		if err!=nil { return err }
+		if tb := loadBucket(bkt,"k",rate,now); tb.tokens!=4 { t.Errorf("new bucket: %v tokens",tb.tokens) }
+		tb := &tokenBucket{[]byte("k"),rate,0}
+		err = tb.store(bkt,now)
+		if err!=nil { return err }
+		if tb = loadBucket(bkt,"k",rate,now.Add(30*time.Minute)); tb.tokens!=2 { t.Errorf("after 30m: %v tokens",tb.tokens) }
+		if tb = loadBucket(bkt,"k",rate,now.Add(3*time.Hour)); tb.tokens!=4 { t.Errorf("after 3h: %v tokens",tb.tokens) }
+		return nil
+	})
+	if err!=nil { t.Fatal(err) }
+}
+
+func TestLimiter(t *testing.T) {
+	dir,_,cleanup := tempQueue(t,"limit")
+	defer cleanup()
+	db := tempDB(t,dir,"limit.db")
+	defer db.Close()
+	l := &Limiter{DB:db,AddressRate:Rate{2,time.Hour},DomainRate:Rate{2,time.Hour},MaxRecipients:3}
+	send := func(to ...string) error { return l.Filter(&qmodel.Message{To:to}) }
+	
+	// The domain bucket has too few tokens for three recipients.
+	if err := send("a@example.org","b@example.org","<C@Example.org>"); err!=ERateLimited { t.Fatal("3 recipients:",err) }
+	
+	// The deferred message took no tokens.
+	if err := send("a@example.org","b@example.org"); err!=nil { t.Fatal("2 recipients:",err) }
+	if err := send("c@example.org"); err!=ERateLimited { t.Fatal("domain:",err) }
+	if err := send("a@example.net"); err!=nil { t.Fatal(err) }
+	if err := send("a@example.net"); err!=nil { t.Fatal(err) }
+	if err := send("A@example.net"); err!=ERateLimited { t.Fatal("address:",err) }
+	
+	if err := send("a@x.org","b@y.org","c@z.org","d@w.org"); err!=ETooManyRecipients { t.Fatal(err) }
+}
@@ -10,8 +10,71 @@
 package handler
 
 import "github.com/a-mail-group/ampp/qmodel"
+import "github.com/a-mail-group/ampp/remailer/cypherpunk"
+import "golang.org/x/crypto/openpgp"
+import "errors"
+import "sync"
+import "time"
+
+var (
+	EBadConfig = errors.New("Handler not configured")
+	
+	// The message has been handled by a filter and must not be enqueued.
+	EDropped = errors.New("Message dropped")
+)
 
 type IQueue interface{
 	EnqueueMessage(queue string,msg *qmodel.Message) error
+	
+	// Enqueues a message unless the idempotency key id has been seen before.
+	EnqueueMessageOnce(queue string,id []byte,msg *qmodel.Message) (dup bool,err error)
+	
+	// Forgets the idempotency keys of messages enqueued before t.
+	ExpireIds(queue string,t time.Time) error
+}
+
+/*
+How long the idempotency keys are kept, unless configured otherwise. The
+source of a message must not deliver it again after this time.
+*/
+const DefaultIdRetention = 30*24*time.Hour
+
+/*
+Expires the idempotency keys of a queue, at most once an hour.
+*/
+type idExpiry struct{
+	lock sync.Mutex
+	last time.Time
+}
+
+func (e *idExpiry) expire(q IQueue,queue string,retention time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	now := time.Now()
+	if now.Sub(e.last)<time.Hour { return }
+	e.last = now
+	if retention<=0 { retention = DefaultIdRetention }
+	q.ExpireIds(queue,now.Add(-retention)) // XXX ignore errors!
 }
 
+
+/*
+Runs cypherpunk.ProcessMessage() followed by the filters. Control messages
+are handled by the filters implementing cypherpunk.RequestFilter before.
+*/
+func processMessage(data []byte, address string, ring openpgp.KeyRing, filters []cypherpunk.Filter) (qmsg *qmodel.Message,err error) {
+	for _,f := range filters {
+		rf,ok := f.(cypherpunk.RequestFilter)
+		if !ok { continue }
+		handled,e := rf.Request(data)
+		if e!=nil { err = e; return }
+		if handled { err = EDropped; return }
+	}
+	qmsg,err = cypherpunk.ProcessMessage(data,address,ring)
+	if err!=nil { return }
+	for _,f := range filters {
+		err = f.Filter(qmsg)
+		if err!=nil { qmsg = nil; return }
+	}
+	return
+}
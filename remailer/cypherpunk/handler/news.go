@@ -0,0 +1,59 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+
+package handler
+
+import "github.com/a-mail-group/ampp/qmodel"
+import "time"
+
+/*
+Enqueues news articles into a separate queue, to be posted by a
+*nntpio.Output. Use it as Target of a handler. Messages that have both mail
+recipients and newsgroups are split into a mail and an article.
+*/
+type NewsSplitter struct{
+	IQueue
+	News string
+}
+
+var _ IQueue = (*NewsSplitter)(nil)
+
+func (s *NewsSplitter) split(msg *qmodel.Message) (mail,article *qmodel.Message) {
+	if len(msg.Newsgroups)==0 { return msg,nil }
+	article = &qmodel.Message{From:msg.From,Body:msg.Body,Newsgroups:msg.Newsgroups}
+	if len(msg.To)!=0 { mail = &qmodel.Message{From:msg.From,To:msg.To,Body:msg.Body} }
+	return
+}
+
+func (s *NewsSplitter) EnqueueMessage(queue string,msg *qmodel.Message) error {
+	mail,article := s.split(msg)
+	if mail!=nil {
+		err := s.IQueue.EnqueueMessage(queue,mail)
+		if err!=nil { return err }
+	}
+	if article==nil { return nil }
+	return s.IQueue.EnqueueMessage(s.News,article)
+}
+
+func (s *NewsSplitter) EnqueueMessageOnce(queue string,id []byte,msg *qmodel.Message) (dup bool,err error) {
+	mail,article := s.split(msg)
+	if mail!=nil {
+		dup,err = s.IQueue.EnqueueMessageOnce(queue,id,mail)
+		if err!=nil { return }
+	}
+	if article==nil { return }
+	// A retry after a failure here enqueues the article only.
+	return s.IQueue.EnqueueMessageOnce(s.News,id,article)
+}
+
+func (s *NewsSplitter) ExpireIds(queue string,t time.Time) error {
+	err := s.IQueue.ExpireIds(queue,t)
+	if err!=nil { return err }
+	return s.IQueue.ExpireIds(s.News,t)
+}
@@ -0,0 +1,48 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package handler
+
+import "github.com/a-mail-group/ampp/nntpio"
+import "golang.org/x/crypto/openpgp"
+import "net"
+import "strings"
+import "testing"
+
+func TestNewsRoundTrip(t *testing.T) {
+	_,q,cleanup := tempQueue(t,"news")
+	defer cleanup()
+	var posted []string
+	s := &nntpio.Server{Post:func(article []byte) error {
+		posted = append(posted,string(article))
+		return nil
+	}}
+	l,err := net.Listen("tcp","127.0.0.1:0")
+	if err!=nil { t.Fatal(err) }
+	defer l.Close()
+	go s.Serve(l)
+	
+	// A message for a mail recipient and a newsgroup is split.
+	h := &SmtpHandler{Ring:openpgp.EntityList{},Address:"remailer@example.org",Target:&NewsSplitter{q,"news"},QueueName:"out"}
+	data := "From: sender@example.org\r\n\r\n::\r\nAnon-To: a@example.org\r\nAnon-Post-To: alt.test\r\n\r\n##\r\nSubject: hello\r\n\r\nbody\r\n"
+	err = h.Send("sender@example.org",[]string{"remailer@example.org"},strings.NewReader(data))
+	if err!=nil { t.Fatal(err) }
+	if n := countQueue(t,q,"out"); n!=1 { t.Fatalf("%d mails",n) }
+	if n := countQueue(t,q,"news"); n!=1 { t.Fatalf("%d articles",n) }
+	
+	o := &nntpio.Output{Q:q,N:"news",Rejected:"rejected",Connector:&nntpio.Connector{Addr:l.Addr().String(),NoTLS:true}}
+	err = o.Process()
+	if err!=nil { t.Fatal(err) }
+	if len(posted)!=1 { t.Fatalf("%d articles posted",len(posted)) }
+	for _,f := range []string{"Newsgroups: alt.test\r\n","Subject: hello\r\n","\r\n\r\nbody\r\n"} {
+		if !strings.Contains(posted[0],f) { t.Errorf("article lacks %q: %q",f,posted[0]) }
+	}
+	if strings.Contains(posted[0],"a@example.org") { t.Errorf("article carries the mail recipient: %q",posted[0]) }
+	if n := countQueue(t,q,"news"); n!=0 { t.Fatalf("%d articles left",n) }
+	if n := countQueue(t,q,"rejected"); n!=0 { t.Fatalf("%d articles rejected",n) }
+}
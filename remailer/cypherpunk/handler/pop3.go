@@ -0,0 +1,135 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+
+package handler
+
+import "github.com/a-mail-group/ampp/remailer/cypherpunk"
+import "github.com/a-mail-group/ampp/pop3io"
+import "golang.org/x/crypto/openpgp"
+import bolt "github.com/coreos/bbolt"
+import "time"
+import "bytes"
+
+var bPop3Uidl = []byte("pop3-uidl")
+
+/*
+Processes remailer messages from a POP3 maildrop. Each call to Process()
+opens a new session, as POP3 commits deletions only at the end of a session.
+*/
+type Pop3Waiter struct{
+	Connector *pop3io.Connector
+	Ring openpgp.KeyRing
+	Address string
+	
+	// Applied to the messages before they are enqueued.
+	Filters []cypherpunk.Filter
+	
+	// Deletes invalid messages, unless Dispositions says otherwise.
+	// Move is not supported by POP3 and is treated as Leave.
+	DelInv bool
+	Dispositions Dispositions
+	
+	Target IQueue
+	QueueName string
+	
+	// Required. Holds the unique ids of the messages that have already been
+	// processed, and the quarantine bucket.
+	State *bolt.DB
+	
+	// How long the idempotency keys of enqueued messages are kept. Zero means
+	// DefaultIdRetention.
+	IdRetention time.Duration
+	
+	ids idExpiry
+}
+
+func (p *Pop3Waiter) uidlKey(uid string) []byte {
+	return []byte(p.Address+"\x00"+uid)
+}
+
+func (p *Pop3Waiter) sourceId(uid string) []byte {
+	return []byte("pop3:"+p.Address+";UIDL="+uid)
+}
+
+/*
+Retrieves and processes the messages that have not been seen before.
+*/
+func (p *Pop3Waiter) Process() error {
+	if p.Connector==nil || p.State==nil { return EBadConfig }
+	c,err := p.Connector.Connect()
+	if err!=nil { return err }
+	defer c.Close()
+	list,err := c.Uidl()
+	if err!=nil { return err }
+	
+	seen := make(map[string]bool)
+	p.State.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bPop3Uidl)
+		if bkt==nil { return nil }
+		for _,e := range list {
+			if bkt.Get(p.uidlKey(e.Uid))!=nil { seen[e.Uid] = true }
+		}
+		return nil
+	})
+	
+	p.ids.expire(p.Target,p.QueueName,p.IdRetention)
+	var done []string
+	for _,e := range list {
+		if seen[e.Uid] { continue }
+		data,err := c.Retr(e.Num)
+		if err!=nil { return err }
+		qmsg,err := processMessage(data,p.Address,p.Ring,p.Filters)
+		if err==nil {
+			_,err = p.Target.EnqueueMessageOnce(p.QueueName,p.sourceId(e.Uid),qmsg)
+			if err==nil {
+				err = c.Dele(e.Num)
+				if err!=nil { return err }
+				done = append(done,e.Uid)
+				continue
+			}
+		}
+		d,class := p.Dispositions.decide(p.State,string(p.sourceId(e.Uid)),err,data,p.DelInv)
+		switch d.Action {
+		case Delete,Quarantine:
+			err = c.Dele(e.Num)
+			if err!=nil { return err }
+		default:
+			if class==CTransient { continue } // Retried on the next call.
+		}
+		done = append(done,e.Uid)
+	}
+	
+	// Record the processed messages before the deletions are committed, so
+	// that a crash can not cause them to be processed twice.
+	err = p.State.Batch(func(tx *bolt.Tx) error {
+		bkt,err := tx.CreateBucketIfNotExists(bPop3Uidl)
+		if err!=nil { return err }
+		for _,uid := range done {
+			err = bkt.Put(p.uidlKey(uid),[]byte{1})
+			if err!=nil { return err }
+		}
+		
+		// Forget the messages that are no longer in the maildrop.
+		present := make(map[string]bool)
+		for _,e := range list { present[string(p.uidlKey(e.Uid))] = true }
+		prefix := p.uidlKey("")
+		var gone [][]byte
+		c := bkt.Cursor()
+		for k,_ := c.Seek(prefix); bytes.HasPrefix(k,prefix); k,_ = c.Next() {
+			if !present[string(k)] { gone = append(gone,append([]byte(nil),k...)) }
+		}
+		for _,k := range gone {
+			err = bkt.Delete(k)
+			if err!=nil { return err }
+		}
+		return nil
+	})
+	if err!=nil { return err }
+	return c.Quit()
+}
@@ -0,0 +1,170 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package handler
+
+import "github.com/a-mail-group/ampp/pop3io"
+import "golang.org/x/crypto/openpgp"
+import "fmt"
+import "net"
+import "net/textproto"
+import "strings"
+import "sync"
+import "testing"
+
+type pop3Message struct{
+	uid string
+	data string
+}
+
+/*
+An in-process POP3 server with a single maildrop. Deletions are committed by
+QUIT only, as in RFC 1939.
+*/
+type pop3Server struct{
+	l net.Listener
+	lock sync.Mutex
+	drop []pop3Message
+	retrieved []string
+}
+
+func newPop3Server(t *testing.T,drop ...pop3Message) *pop3Server {
+	l,err := net.Listen("tcp","127.0.0.1:0")
+	if err!=nil { t.Fatal(err) }
+	s := &pop3Server{l:l,drop:drop}
+	go func() {
+		for {
+			c,err := l.Accept()
+			if err!=nil { return }
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *pop3Server) uids() (uids []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _,m := range s.drop { uids = append(uids,m.uid) }
+	return
+}
+
+func (s *pop3Server) serve(conn net.Conn) {
+	c := textproto.NewConn(conn)
+	defer c.Close()
+	s.lock.Lock()
+	drop := append([]pop3Message(nil),s.drop...)
+	s.lock.Unlock()
+	deleted := make(map[int]bool)
+	msg := func(arg string) (int,bool) {
+		var n int
+		_,err := fmt.Sscanf(arg,"%d",&n)
+		if err!=nil || n<1 || n>len(drop) || deleted[n] { c.PrintfLine("-ERR no such message"); return 0,false }
+		return n,true
+	}
+	c.PrintfLine("+OK POP3 ready")
+	for {
+		line,err := c.ReadLine()
+		if err!=nil { return }
+		cmd,arg := line,""
+		if i := strings.IndexByte(line,' '); i>=0 { cmd,arg = line[:i],line[i+1:] }
+		switch strings.ToUpper(cmd) {
+		case "CAPA":
+			c.PrintfLine("+OK\r\nUSER\r\nUIDL\r\n.")
+		case "USER":
+			c.PrintfLine("+OK")
+		case "PASS":
+			if arg!="secret" { c.PrintfLine("-ERR invalid password"); continue }
+			c.PrintfLine("+OK")
+		case "UIDL":
+			c.PrintfLine("+OK")
+			for i,m := range drop {
+				if !deleted[i+1] { c.PrintfLine("%d %s",i+1,m.uid) }
+			}
+			c.PrintfLine(".")
+		case "RETR":
+			n,ok := msg(arg)
+			if !ok { continue }
+			s.lock.Lock()
+			s.retrieved = append(s.retrieved,drop[n-1].uid)
+			s.lock.Unlock()
+			c.PrintfLine("+OK")
+			w := c.DotWriter()
+			w.Write([]byte(drop[n-1].data))
+			w.Close()
+		case "DELE":
+			n,ok := msg(arg)
+			if !ok { continue }
+			deleted[n] = true
+			c.PrintfLine("+OK")
+		case "QUIT":
+			s.lock.Lock()
+			s.drop = s.drop[:0]
+			for i,m := range drop {
+				if !deleted[i+1] { s.drop = append(s.drop,m) }
+			}
+			s.lock.Unlock()
+			c.PrintfLine("+OK bye")
+			return
+		default:
+			c.PrintfLine("-ERR unknown command")
+		}
+	}
+}
+
+func TestPop3Waiter(t *testing.T) {
+	dir,q,cleanup := tempQueue(t,"pop3")
+	defer cleanup()
+	state := tempDB(t,dir,"state.db")
+	defer state.Close()
+	
+	s := newPop3Server(t,
+		pop3Message{"u1",remailMessage("a@example.org")},
+		pop3Message{"u2","Subject: spam\r\n\r\nnot a remailer message\r\n"},
+		pop3Message{"u3",remailMessage("b@example.org")})
+	defer s.l.Close()
+	p := &Pop3Waiter{
+		Connector: &pop3io.Connector{Addr:s.l.Addr().String(),NoTLS:true,Username:"r",Password:"secret"},
+		Ring: openpgp.EntityList{},
+		Address: "remailer@example.org",
+		Target: q,
+		QueueName: "out",
+		State: state,
+	}
+	
+	err := p.Process()
+	if err!=nil { t.Fatal(err) }
+	if n := countQueue(t,q,"out"); n!=2 { t.Fatalf("%d messages enqueued",n) }
+	// The invalid message is left in place, the others are deleted.
+	if uids := s.uids(); len(uids)!=1 || uids[0]!="u2" { t.Fatalf("maildrop %v",uids) }
+	
+	// Messages recorded in the UIDL state are not retrieved again.
+	s.lock.Lock()
+	s.drop = append(s.drop,pop3Message{"u4",remailMessage("c@example.org")})
+	s.retrieved = nil
+	s.lock.Unlock()
+	err = p.Process()
+	if err!=nil { t.Fatal(err) }
+	if fmt.Sprint(s.retrieved)!="[u4]" { t.Fatalf("retrieved %v",s.retrieved) }
+	if n := countQueue(t,q,"out"); n!=3 { t.Fatalf("%d messages enqueued",n) }
+	
+	// Without the UIDL state (a crash before the deletions were committed),
+	// the idempotency key of the queue still catches the duplicate.
+	s.lock.Lock()
+	s.drop = append(s.drop,pop3Message{"u4",remailMessage("c@example.org")})
+	s.lock.Unlock()
+	p.State = tempDB(t,dir,"state2.db")
+	defer p.State.Close()
+	err = p.Process()
+	if err!=nil { t.Fatal(err) }
+	if n := countQueue(t,q,"out"); n!=3 { t.Fatalf("duplicate enqueued: %d messages",n) }
+	if uids := s.uids(); len(uids)!=1 || uids[0]!="u2" { t.Fatalf("duplicate not deleted: %v",uids) }
+	
+	p.Connector.Password = "wrong"
+	if p.Process()==nil { t.Fatal("login with a wrong password") }
+}
@@ -0,0 +1,123 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+
+package handler
+
+import "github.com/a-mail-group/ampp/remailer/cypherpunk"
+import "golang.org/x/crypto/openpgp"
+import "github.com/emersion/go-smtp"
+import "io"
+import "io/ioutil"
+import "bytes"
+import "strings"
+import "time"
+
+var (
+	ESmtpNotRemail = &smtp.SMTPError{Code:550, Message:"5.7.1 Not a remailer message"}
+	ESmtpCrypto = &smtp.SMTPError{Code:550, Message:"5.7.5 Cryptographic failure"}
+	ESmtpInvalid = &smtp.SMTPError{Code:554, Message:"5.6.0 Invalid remailer message"}
+	ESmtpTemporary = &smtp.SMTPError{Code:451, Message:"4.3.0 Temporary failure, try again later"}
+	ESmtpNoMailbox = &smtp.SMTPError{Code:550, Message:"5.1.1 Mailbox unavailable"}
+)
+
+/*
+A SMTP backend (go-smtp v0.10) that processes remailer messages directly after
+DATA, without a mailbox in between. Messages to Address are decrypted with
+cypherpunk.ProcessMessage() and the result is enqueued.
+*/
+type SmtpHandler struct{
+	Ring openpgp.KeyRing
+	Address string
+
+	// Applied to the messages before they are enqueued.
+	Filters []cypherpunk.Filter
+
+	Target IQueue
+	QueueName string
+
+	// If not nil, mail for other recipients is passed to this user (for
+	// example a *smtpio.Input). Otherwise it is rejected.
+	Other smtp.User
+
+	// If set, messages that can not be processed are accepted and dropped,
+	// so that the server does not act as a decryption oracle. Only a failure
+	// to enqueue a message is reported, as a temporary failure.
+	Silent bool
+
+	// Maximum message size. Zero means 3 MiB.
+	MaxSize int
+
+	// How long the idempotency keys of enqueued messages are kept. Zero means
+	// DefaultIdRetention.
+	IdRetention time.Duration
+
+	ids idExpiry
+}
+
+func (h *SmtpHandler) Login(state *smtp.ConnectionState, username, password string) (smtp.User, error) {
+	return nil,smtp.ErrAuthUnsupported
+}
+func (h *SmtpHandler) AnonymousLogin(state *smtp.ConnectionState) (smtp.User, error) { return h,nil }
+
+var _ smtp.Backend = (*SmtpHandler)(nil)
+
+func (h *SmtpHandler) isRemailer(addr string) bool {
+	addr = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(addr),"<"),">")
+	return strings.EqualFold(addr,h.Address)
+}
+
+/*
+Maps the error class to a SMTP reply.
+*/
+func smtpReply(class ErrorClass) error {
+	switch class {
+	case CNotRemail: return ESmtpNotRemail
+	case CKey: return ESmtpCrypto
+	case CTransient: return ESmtpTemporary
+	}
+	return ESmtpInvalid
+}
+
+func (h *SmtpHandler) Send(from string, to []string, r io.Reader) error {
+	max := h.MaxSize
+	if max<=0 { max = 3<<20 }
+	data,err := ioutil.ReadAll(io.LimitReader(r,int64(max)+1))
+	if err!=nil { return err }
+	if len(data)>max { return smtp.ErrDataTooLarge }
+
+	var remail bool
+	var other []string
+	for _,rcpt := range to {
+		if h.isRemailer(rcpt) {
+			remail = true
+		} else {
+			other = append(other,rcpt)
+		}
+	}
+	if len(other)!=0 && h.Other==nil { return ESmtpNoMailbox }
+
+	// The remailer part is processed first: if the client retries the
+	// transaction after a failure of the other part, the messageKey() of the
+	// message is used to detect the duplicate.
+	if remail {
+		qmsg,err := processMessage(data,h.Address,h.Ring,h.Filters)
+		if err==nil {
+			_,err = h.Target.EnqueueMessageOnce(h.QueueName,[]byte("smtp:"+h.Address+";"+messageKey(data)),qmsg)
+			if err!=nil { return ESmtpTemporary }
+			h.ids.expire(h.Target,h.QueueName,h.IdRetention)
+		} else if class := Classify(err); class!=CDropped && !h.Silent {
+			return smtpReply(class)
+		}
+	}
+	if len(other)!=0 { return h.Other.Send(from,other,bytes.NewReader(data)) }
+	return nil
+}
+func (h *SmtpHandler) Logout() error { return nil }
+
+var _ smtp.User = (*SmtpHandler)(nil)
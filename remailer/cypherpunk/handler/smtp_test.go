@@ -0,0 +1,59 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package handler
+
+import "github.com/a-mail-group/ampp/qmodel"
+import "github.com/a-mail-group/ampp/remailer/cypherpunk"
+import "golang.org/x/crypto/openpgp"
+import "strings"
+import "testing"
+
+func TestSmtpHandlerDedupe(t *testing.T) {
+	_,q,cleanup := tempQueue(t,"smtp")
+	defer cleanup()
+	h := &SmtpHandler{Ring:openpgp.EntityList{},Address:"remailer@example.org",Target:q,QueueName:"out"}
+	send := func(data string) {
+		err := h.Send("sender@example.org",[]string{"<remailer@example.org>"},strings.NewReader(data))
+		if err!=nil { t.Fatal(err) }
+	}
+	
+	a := "Message-Id: <same@example.org>\r\n"+remailMessage("a@example.org")
+	send(a)
+	send(a) // A retried transaction.
+	if n := countQueue(t,q,"out"); n!=1 { t.Fatalf("retry enqueued: %d messages",n) }
+	
+	// A distinct message, that reuses the Message-Id.
+	send("Message-Id: <same@example.org>\r\n"+remailMessage("b@example.org"))
+	if n := countQueue(t,q,"out"); n!=2 { t.Fatalf("distinct message dropped: %d messages",n) }
+}
+
+type failFilter struct{ err error }
+
+func (f failFilter) Filter(qmsg *qmodel.Message) error { return f.err }
+
+func TestSmtpHandlerSilent(t *testing.T) {
+	_,q,cleanup := tempQueue(t,"smtp")
+	defer cleanup()
+	h := &SmtpHandler{Ring:openpgp.EntityList{},Address:"remailer@example.org",Target:q,QueueName:"out",Silent:true}
+	send := func(data string) error {
+		return h.Send("sender@example.org",[]string{"remailer@example.org"},strings.NewReader(data))
+	}
+	
+	// Processing failures, transient ones included, are not revealed.
+	h.Filters = []cypherpunk.Filter{failFilter{ERateLimited}}
+	for _,data := range []string{"Subject: spam\r\n\r\nnot a remailer message\r\n",remailMessage("a@example.org")} {
+		if err := send(data); err!=nil { t.Errorf("%.20q: %v",data,err) }
+	}
+	if n := countQueue(t,q,"out"); n!=0 { t.Fatalf("%d messages enqueued",n) }
+	
+	// A failure to enqueue the message is.
+	h.Filters = nil
+	q.Close()
+	if err := send(remailMessage("a@example.org")); err!=ESmtpTemporary { t.Fatal(err) }
+}
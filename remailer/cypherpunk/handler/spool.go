@@ -0,0 +1,267 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+
+package handler
+
+import "github.com/a-mail-group/ampp/remailer/cypherpunk"
+import "golang.org/x/crypto/openpgp"
+import bolt "github.com/coreos/bbolt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "bytes"
+import "errors"
+import "fmt"
+import "crypto/sha256"
+import "time"
+
+var (
+	ELocked = errors.New("Mailbox is locked")
+)
+
+/*
+Processes remailer messages delivered by a local MTA, either into a Maildir
+or into a mbox file. Exactly one of Maildir and Mbox must be set.
+
+For a Maildir, Disposition.Folder (Move) is the path of another Maildir. For
+a mbox, it is the path of another mbox file.
+*/
+type SpoolWaiter struct{
+	Maildir string
+	Mbox string
+
+	Ring openpgp.KeyRing
+	Address string
+
+	// Applied to the messages before they are enqueued.
+	Filters []cypherpunk.Filter
+
+	// Deletes invalid messages, unless Dispositions says otherwise.
+	DelInv bool
+	Dispositions Dispositions
+
+	Target IQueue
+	QueueName string
+
+	// Optional. Holds the quarantine bucket.
+	State *bolt.DB
+
+	// Poll interval for Run(). Zero means 10 seconds.
+	PollInterval time.Duration
+
+	// How long the idempotency keys of enqueued messages are kept. Zero means
+	// DefaultIdRetention.
+	IdRetention time.Duration
+
+	ids idExpiry
+}
+
+/*
+Processes one message. The returned disposition is Delete if the message
+has been enqueued. If retry is true, the message must be left in place.
+*/
+func (s *SpoolWaiter) handle(id string, data []byte) (d Disposition,retry bool) {
+	qmsg,err := processMessage(data,s.Address,s.Ring,s.Filters)
+	if err==nil {
+		_,err = s.Target.EnqueueMessageOnce(s.QueueName,[]byte(id),qmsg)
+		if err==nil { return Disposition{Action:Delete},false }
+	}
+	d,class := s.Dispositions.decide(s.State,id,err,data,s.DelInv)
+	retry = d.Action==Leave && class==CTransient
+	return
+}
+
+/*
+Processes the messages that are currently in the spool.
+*/
+func (s *SpoolWaiter) Process() error {
+	s.ids.expire(s.Target,s.QueueName,s.IdRetention)
+	switch {
+	case s.Maildir!="": return s.processMaildir()
+	case s.Mbox!="": return s.processMbox()
+	}
+	return EBadConfig
+}
+
+/*
+Polls the spool until stop is closed.
+*/
+func (s *SpoolWaiter) Run(stop <-chan struct{}) error {
+	interval := s.PollInterval
+	if interval<=0 { interval = 10*time.Second }
+	for {
+		err := s.Process()
+		if err!=nil && err!=ELocked { return err }
+		select {
+		case <-stop: return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+/*
+Processes the messages in new/. Messages that are left in place are moved to
+cur/ and flagged as seen, unless they failed transiently.
+*/
+func (s *SpoolWaiter) processMaildir() error {
+	newdir := filepath.Join(s.Maildir,"new")
+	files,err := ioutil.ReadDir(newdir)
+	if err!=nil { return err }
+	for _,fi := range files {
+		name := fi.Name()
+		if strings.HasPrefix(name,".") || !fi.Mode().IsRegular() { continue }
+		path := filepath.Join(newdir,name)
+		data,err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) { continue } // Taken by another process.
+		if err!=nil { return err }
+		unique := name
+		if i := strings.IndexByte(unique,':'); i>=0 { unique = unique[:i] }
+		d,retry := s.handle("maildir:"+s.Maildir+";"+unique,data)
+		if retry { continue }
+		switch d.Action {
+		case Leave:
+			err = os.Rename(path,filepath.Join(s.Maildir,"cur",unique+":2,S"))
+		case Move:
+			err = os.Rename(path,filepath.Join(d.Folder,"new",unique))
+		default:
+			err = os.Remove(path)
+		}
+		if err!=nil && !os.IsNotExist(err) { return err }
+	}
+	return nil
+}
+
+/*
+Locks a mbox file using a dot-lock.
+*/
+func dotLock(path string) (unlock func(),err error) {
+	lock := path+".lock"
+	for n := 0; n<10; n++ {
+		var f *os.File
+		f,err = os.OpenFile(lock,os.O_WRONLY|os.O_CREATE|os.O_EXCL,0600)
+		if err==nil {
+			f.Close()
+			return func() { os.Remove(lock) },nil
+		}
+		if !os.IsExist(err) { return }
+		time.Sleep(100*time.Millisecond)
+	}
+	err = ELocked
+	return
+}
+
+/*
+Splits a mbox into its messages, including the "From " lines.
+*/
+func splitMbox(data []byte) (msgs [][]byte) {
+	start := -1
+	for pos := 0; pos<len(data); {
+		end := bytes.IndexByte(data[pos:],'\n')
+		if end<0 { end = len(data) } else { end += pos+1 }
+		if bytes.HasPrefix(data[pos:],[]byte("From ")) {
+			if start>=0 { msgs = append(msgs,data[start:pos]) }
+			start = pos
+		}
+		pos = end
+	}
+	if start>=0 { msgs = append(msgs,data[start:]) }
+	return
+}
+
+/*
+Removes the "From " line and the >From quoting (mboxrd) from a message.
+*/
+func unquoteMbox(raw []byte) []byte {
+	if i := bytes.IndexByte(raw,'\n'); i>=0 { raw = raw[i+1:] } else { raw = nil }
+	buf := new(bytes.Buffer)
+	for _,line := range bytes.SplitAfter(raw,[]byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line,">"),[]byte("From ")) && line[0]=='>' { line = line[1:] }
+		buf.Write(line)
+	}
+	return buf.Bytes()
+}
+
+func appendFile(path string, data []byte) error {
+	f,err := os.OpenFile(path,os.O_WRONLY|os.O_CREATE|os.O_APPEND,0600)
+	if err!=nil { return err }
+	_,err = f.Write(data)
+	if e := f.Close(); err==nil { err = e }
+	return err
+}
+
+/*
+Appends a message to a mbox file, under its dot-lock.
+*/
+func appendMbox(path string, data []byte) error {
+	unlock,err := dotLock(path)
+	if err!=nil { return err }
+	defer unlock()
+	return appendFile(path,data)
+}
+
+/*
+Processes the messages in the mbox file. The file is rewritten with the
+messages that are left in place.
+*/
+func (s *SpoolWaiter) processMbox() error {
+	unlock,err := dotLock(s.Mbox)
+	if err!=nil { return err }
+	defer unlock()
+	f,err := os.OpenFile(s.Mbox,os.O_RDWR,0)
+	if os.IsNotExist(err) { return nil }
+	if err!=nil { return err }
+	defer f.Close()
+	data,err := ioutil.ReadAll(f)
+	if err!=nil { return err }
+
+	keep := new(bytes.Buffer)
+	for _,raw := range splitMbox(data) {
+		body := unquoteMbox(raw)
+		// The mbox has no unique ids, so the content is used.
+		d,retry := s.handle("mbox:"+s.Mbox+";"+messageKey(body),body)
+		switch {
+		case retry,d.Action==Leave:
+			keep.Write(raw)
+		case d.Action==Move:
+			err = appendMbox(d.Folder,raw)
+			if err!=nil { keep.Write(raw) }
+		}
+	}
+	if keep.Len()==len(data) { return nil }
+	return rewriteFile(f,keep.Bytes(),int64(len(data)))
+}
+
+/*
+Rewrites a file in place: data is copied to the start of the file, followed by
+anything appended after the first size bytes were read, and the file is
+truncated. The file keeps its inode, so that no message is lost by a writer,
+that still holds the file open.
+*/
+func rewriteFile(f *os.File, data []byte, size int64) error {
+	_,err := f.Seek(size,io.SeekStart)
+	if err!=nil { return err }
+	tail,err := ioutil.ReadAll(f)
+	if err!=nil { return err }
+	data = append(data,tail...)
+	_,err = f.WriteAt(data,0)
+	if err!=nil { return err }
+	err = f.Truncate(int64(len(data)))
+	if err!=nil { return err }
+	return f.Sync()
+}
+
+/*
+Returns a key, that identifies a raw message by its content. Unlike the
+Message-Id, it does not collide for distinct messages, that reuse an id.
+*/
+func messageKey(raw []byte) string {
+	return fmt.Sprintf("sha256:%x",sha256.Sum256(raw))
+}
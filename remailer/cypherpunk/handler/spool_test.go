@@ -0,0 +1,74 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package handler
+
+import "golang.org/x/crypto/openpgp"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+
+func TestSpoolMbox(t *testing.T) {
+	dir,q,cleanup := tempQueue(t,"spool")
+	defer cleanup()
+	
+	// Two distinct messages reusing one Message-Id, and an invalid message.
+	msg := func(to string) string {
+		return "From sender@example.org Mon Jan  1 00:00:00 2018\nMessage-Id: <same@example.org>\n"+strings.Replace(remailMessage(to),"\r\n","\n",-1)
+	}
+	invalid := "From spam@example.org Mon Jan  1 00:00:00 2018\nSubject: spam\n\nnot a remailer message\n"
+	mbox := filepath.Join(dir,"mbox")
+	err := ioutil.WriteFile(mbox,[]byte(msg("a@example.org")+invalid+msg("b@example.org")),0640)
+	if err!=nil { t.Fatal(err) }
+	before,err := os.Stat(mbox)
+	if err!=nil { t.Fatal(err) }
+	
+	s := &SpoolWaiter{Mbox:mbox,Ring:openpgp.EntityList{},Address:"remailer@example.org",Target:q,QueueName:"out"}
+	err = s.Process()
+	if err!=nil { t.Fatal(err) }
+	if n := countQueue(t,q,"out"); n!=2 { t.Fatalf("%d messages enqueued",n) }
+	
+	data,err := ioutil.ReadFile(mbox)
+	if err!=nil { t.Fatal(err) }
+	if string(data)!=invalid { t.Fatalf("mbox %q",data) }
+	
+	// The mbox is rewritten in place.
+	fi,err := os.Stat(mbox)
+	if err!=nil { t.Fatal(err) }
+	if !os.SameFile(fi,before) { t.Fatal("mbox replaced") }
+	if fi.Mode().Perm()!=0640 { t.Fatalf("mode %v",fi.Mode()) }
+	if _,err = os.Stat(mbox+".lock"); !os.IsNotExist(err) { t.Fatal("lock not released") }
+	
+	// The same message delivered again is a duplicate.
+	err = appendFile(mbox,[]byte(msg("a@example.org")))
+	if err!=nil { t.Fatal(err) }
+	err = s.Process()
+	if err!=nil { t.Fatal(err) }
+	if n := countQueue(t,q,"out"); n!=2 { t.Fatalf("duplicate enqueued: %d messages",n) }
+	data,_ = ioutil.ReadFile(mbox)
+	if string(data)!=invalid { t.Fatalf("duplicate not removed: %q",data) }
+	
+	// Invalid messages are moved into another mbox, under its lock.
+	rejected := filepath.Join(dir,"rejected")
+	s.Dispositions = Dispositions{CNotRemail:{Action:Move,Folder:rejected}}
+	unlock,err := dotLock(rejected)
+	if err!=nil { t.Fatal(err) }
+	err = s.Process()
+	unlock()
+	if err!=nil { t.Fatal(err) }
+	data,_ = ioutil.ReadFile(mbox)
+	if string(data)!=invalid { t.Fatalf("moved into a locked mbox: %q",data) }
+	err = s.Process()
+	if err!=nil { t.Fatal(err) }
+	data,_ = ioutil.ReadFile(rejected)
+	if string(data)!=invalid { t.Fatalf("rejected %q",data) }
+	data,_ = ioutil.ReadFile(mbox)
+	if len(data)!=0 { t.Fatalf("not moved: %q",data) }
+}
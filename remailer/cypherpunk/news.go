@@ -0,0 +1,102 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package cypherpunk
+
+import "github.com/a-mail-group/ampp/qmodel"
+import "github.com/a-mail-group/ampp/crypto/boxpgp"
+import "bytes"
+import "errors"
+import "fmt"
+import "regexp"
+import "strings"
+import "time"
+
+var (
+	EBadNewsgroup = errors.New("Invalid newsgroup name")
+)
+
+var r_newsgroup = regexp.MustCompile(`^[a-zA-Z0-9+_-]+(\.[a-zA-Z0-9+_-]+)*$`)
+
+/*
+Headers that are set by the injecting news server (RFC 5537), or that would
+give the article special powers. They are removed from posted articles.
+*/
+var newsStripHeaders = map[string]bool{
+	"Path": true,
+	"Newsgroups": true,
+	"Xref": true,
+	"Lines": true,
+	"Injection-Date": true,
+	"Injection-Info": true,
+	"Nntp-Posting-Host": true,
+	"Nntp-Posting-Date": true,
+	"X-Trace": true,
+	"X-Complaints-To": true,
+	"Sender": true,
+	"Approved": true,
+	"Control": true,
+	"Supersedes": true,
+	"Also-Control": true,
+}
+
+/*
+Parses the Anon-Post-To headers into a list of newsgroups.
+*/
+func parseNewsgroups(values []string) (groups []string,err error) {
+	for _,v := range values {
+		for _,g := range strings.Split(v,",") {
+			g = strings.TrimSpace(g)
+			if g=="" { continue }
+			if !r_newsgroup.MatchString(g) { err = EBadNewsgroup; return }
+			groups = append(groups,g)
+		}
+	}
+	return
+}
+
+/*
+Turns the message after the "##" line into a news article for the given
+newsgroups. Injection headers are removed and the headers required by
+RFC 5536 are added if missing.
+*/
+func newsArticle(groups []string, from string, msg []byte) []byte {
+	fields,body := boxpgp.SplitHeader(msg)
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf,"Newsgroups: %s\r\n",strings.Join(groups,","))
+	has := make(map[string]bool)
+	for _,f := range fields {
+		if newsStripHeaders[f.Name] { continue }
+		has[f.Name] = true
+		buf.Write(f.Lines)
+	}
+	if !has["From"] { fmt.Fprintf(buf,"From: %s\r\n",from) }
+	if !has["Subject"] { buf.WriteString("Subject: (none)\r\n") }
+	if !has["Date"] { fmt.Fprintf(buf,"Date: %s\r\n",time.Now().UTC().Format(time.RFC1123Z)) }
+	if !has["Message-Id"] { fmt.Fprintf(buf,"Message-Id: %s\r\n",newMessageId(from)) }
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+/*
+Routes news articles to a mail2news gateway. The article is sent by mail to
+Address; the gateway posts it to the groups in its Newsgroups header.
+*/
+type NewsGateway struct{
+	Address string
+}
+
+var _ Filter = (*NewsGateway)(nil)
+
+func (g *NewsGateway) Filter(qmsg *qmodel.Message) error {
+	if len(qmsg.Newsgroups)==0 { return nil }
+	qmsg.To = append(qmsg.To,g.Address)
+	qmsg.Newsgroups = nil
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package cypherpunk
+
+import "github.com/a-mail-group/ampp/crypto/boxpgp"
+import "golang.org/x/crypto/openpgp"
+import "golang.org/x/crypto/openpgp/armor"
+import "net/textproto"
+import "bytes"
+import "errors"
+import "fmt"
+import "io"
+import "regexp"
+import "strings"
+
+var (
+	EBadEncryptTo = errors.New("No public key matching Encrypt-To")
+)
+
+var (
+	r_payloadline = regexp.MustCompile(`(?m)^\*\*\r?(?:\n|\z)`)
+	r_hex = regexp.MustCompile(`^[0-9a-f]+$`)
+	r_pubkeyblock = regexp.MustCompile(`(?s)-----BEGIN PGP PUBLIC KEY BLOCK-----.*?-----END PGP PUBLIC KEY BLOCK-----\r?\n?`)
+)
+
+/*
+Splits msg at the "**" line, which is removed. Without such a line, the
+payload is the body after the pasted headers.
+*/
+func splitPayload(msg []byte) (head, payload []byte) {
+	if loc := r_payloadline.FindIndex(msg); loc!=nil {
+		return msg[:loc[0]],msg[loc[1]:]
+	}
+	_,body := boxpgp.SplitHeader(msg)
+	n := len(msg)-len(body)
+	return msg[:n],msg[n:]
+}
+
+/*
+Returns the keys in keys matching Encrypt-To, by e-mail address or by
+(short, long or full) hexadecimal key id.
+*/
+func matchKeys(keys openpgp.EntityList, to string) (match []*openpgp.Entity) {
+	to = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(to),"<"),">"))
+	hex := strings.TrimPrefix(to,"0x")
+	if len(hex)<8 || !r_hex.MatchString(hex) { hex = "" }
+	for _,e := range keys {
+		ok := hex!="" && strings.HasSuffix(fmt.Sprintf("%x",e.PrimaryKey.Fingerprint),hex)
+		for _,id := range e.Identities {
+			if id.UserId!=nil && strings.EqualFold(id.UserId.Email,to) { ok = true }
+		}
+		if ok { match = append(match,e) }
+	}
+	return
+}
+
+func armorEncrypt(payload []byte, encrypt func(w io.Writer) (io.WriteCloser,error)) ([]byte,error) {
+	buf := new(bytes.Buffer)
+	aw,err := armor.Encode(buf,"PGP MESSAGE",nil)
+	if err!=nil { return nil,err }
+	ew,err := encrypt(aw)
+	if err!=nil { return nil,err }
+	_,err = ew.Write(payload)
+	if err!=nil { return nil,err }
+	err = ew.Close()
+	if err!=nil { return nil,err }
+	err = aw.Close()
+	if err!=nil { return nil,err }
+	buf.WriteString("\r\n")
+	return buf.Bytes(),nil
+}
+
+/*
+Handles the Encrypt-To and Encrypt-Key headers. The payload is encrypted to
+the public key named by Encrypt-To, which must be supplied as armored key
+block in the message (it is removed), and then symmetrically with the
+Encrypt-Key passphrase. Reply blocks use this so that intermediate hops
+never see the plaintext.
+*/
+func reencrypt(h textproto.MIMEHeader, msg []byte) ([]byte,error) {
+	to,key := h.Get("Encrypt-To"),h.Get("Encrypt-Key")
+	if to=="" && key=="" { return msg,nil }
+	var recipients []*openpgp.Entity
+	if to!="" {
+		loc := r_pubkeyblock.FindIndex(msg)
+		if loc==nil { return nil,EBadEncryptTo }
+		keys,err := openpgp.ReadArmoredKeyRing(bytes.NewReader(msg[loc[0]:loc[1]]))
+		if err!=nil { return nil,EBadEncryptTo }
+		recipients = matchKeys(keys,to)
+		if len(recipients)==0 { return nil,EBadEncryptTo }
+		msg = append(append([]byte(nil),msg[:loc[0]]...),msg[loc[1]:]...)
+	}
+	head,payload := splitPayload(msg)
+	var err error
+	if recipients!=nil {
+		payload,err = armorEncrypt(payload,func(w io.Writer) (io.WriteCloser,error) {
+			return openpgp.Encrypt(w,recipients,nil,nil,nil)
+		})
+		if err!=nil { return nil,err }
+	}
+	if key!="" {
+		payload,err = armorEncrypt(payload,func(w io.Writer) (io.WriteCloser,error) {
+			return openpgp.SymmetricallyEncrypt(w,[]byte(key),nil,nil)
+		})
+		if err!=nil { return nil,err }
+	}
+	return append(append([]byte(nil),head...),payload...),nil
+}
@@ -0,0 +1,77 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package cypherpunk
+
+import "github.com/a-mail-group/ampp/crypto/boxpgp"
+import "golang.org/x/crypto/openpgp"
+import "golang.org/x/crypto/openpgp/armor"
+import pgperrs "golang.org/x/crypto/openpgp/errors"
+import "bytes"
+import "io/ioutil"
+import "strings"
+import "testing"
+
+/*
+Decrypts an armored message with a passphrase or a key ring.
+*/
+func decryptArmored(t *testing.T,data []byte,pass string,ring openpgp.KeyRing) []byte {
+	blk,err := armor.Decode(bytes.NewReader(data))
+	if err!=nil { t.Fatal(err) }
+	tried := false
+	md,err := openpgp.ReadMessage(blk.Body,ring,func(keys []openpgp.Key, symmetric bool) ([]byte,error) {
+		if tried || !symmetric { return nil,pgperrs.ErrKeyIncorrect }
+		tried = true
+		return []byte(pass),nil
+	},nil)
+	if err!=nil { t.Fatal(err) }
+	clear,err := ioutil.ReadAll(md.UnverifiedBody)
+	if err!=nil { t.Fatal(err) }
+	return clear
+}
+
+func armoredPublicKey(t *testing.T,e *openpgp.Entity) string {
+	buf := new(bytes.Buffer)
+	w,err := armor.Encode(buf,openpgp.PublicKeyType,nil)
+	if err!=nil { t.Fatal(err) }
+	err = e.Serialize(w)
+	if err!=nil { t.Fatal(err) }
+	w.Close()
+	return buf.String()+"\r\n"
+}
+
+func TestEncryptKey(t *testing.T) {
+	msg := "From: a@example.org\r\n\r\n::\r\nAnon-To: b@example.org\r\nEncrypt-Key: s3cret\r\n\r\n##\r\nSubject: reply\r\n\r\n**\r\nthe payload\r\n"
+	qmsg,err := ProcessMessage([]byte(msg),"remailer@example.org",nil)
+	if err!=nil { t.Fatal(err) }
+	body := string(qmsg.Body)
+	if !strings.HasPrefix(body,"Subject: reply\r\n\r\n-----BEGIN PGP MESSAGE-----") { t.Fatalf("body %q",body) }
+	if strings.Contains(body,"the payload") { t.Fatal("payload in the clear") }
+	clear := decryptArmored(t,qmsg.Body[len("Subject: reply\r\n\r\n"):],"s3cret",nil)
+	if string(clear)!="the payload\r\n" { t.Fatalf("payload %q",clear) }
+}
+
+func TestEncryptTo(t *testing.T) {
+	bob := testKey(t,"bob@example.org")
+	msg := "From: a@example.org\r\n\r\n::\r\nAnon-To: bob@example.org\r\nEncrypt-To: <Bob@example.org>\r\nEncrypt-Key: pw\r\n\r\n##\r\nSubject: hi\r\n"+
+		armoredPublicKey(t,bob)+"\r\nthe payload\r\n"
+	qmsg,err := ProcessMessage([]byte(msg),"remailer@example.org",nil)
+	if err!=nil { t.Fatal(err) }
+	head,payload := boxpgp.SplitHeader(qmsg.Body)
+	if len(head)!=1 || head[0].Name!="Subject" { t.Fatalf("header %q",qmsg.Body) }
+	if bytes.Contains(qmsg.Body,[]byte("PUBLIC KEY")) { t.Fatal("key block not removed") }
+	
+	// The symmetric layer is outside.
+	inner := decryptArmored(t,payload,"pw",nil)
+	clear := decryptArmored(t,inner,"",openpgp.EntityList{bob})
+	if string(clear)!="the payload\r\n" { t.Fatalf("payload %q",clear) }
+	
+	// Without the key block.
+	msg = "From: a@example.org\r\n\r\n::\r\nAnon-To: bob@example.org\r\nEncrypt-To: bob@example.org\r\n\r\n##\r\n\r\nthe payload\r\n"
+	if _,err = ProcessMessage([]byte(msg),"remailer@example.org",nil); err!=EBadEncryptTo { t.Fatal(err) }
+}
@@ -0,0 +1,139 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package cypherpunk
+
+import "golang.org/x/crypto/openpgp"
+import "golang.org/x/crypto/openpgp/armor"
+import pgperrs "golang.org/x/crypto/openpgp/errors"
+import "bufio"
+import "bytes"
+import "crypto/rand"
+import "encoding/base64"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+
+var (
+	ENoHops = errors.New("Reply block needs at least one hop")
+)
+
+/*
+A remailer in a chain.
+*/
+type Hop struct{
+	Address string
+	Key *openpgp.Entity
+}
+
+/*
+A reusable reply block. To reply, a message is sent to Remailer with the
+Block followed by the payload as body. Each hop re-encrypts the payload with
+its passphrase, so the recipient needs Passphrases to read the reply.
+*/
+type ReplyBlock struct{
+	Remailer string
+	Block []byte
+	
+	// The Encrypt-Key passphrases, first hop first.
+	Passphrases []string
+}
+
+func newPassphrase() (string,error) {
+	var b [18]byte
+	_,err := rand.Read(b[:])
+	if err!=nil { return "",err }
+	return base64.RawURLEncoding.EncodeToString(b[:]),nil
+}
+
+/*
+Encrypts a layer of the reply block to the key of a hop.
+*/
+func encryptLayer(clear []byte, key *openpgp.Entity) ([]byte,error) {
+	buf := new(bytes.Buffer)
+	buf.WriteString("::\r\nEncrypted: PGP\r\n\r\n")
+	enc1,err := armor.Encode(buf,"PGP MESSAGE",make(map[string]string))
+	if err!=nil { return nil,err }
+	enc2,err := openpgp.Encrypt(enc1,[]*openpgp.Entity{key},nil,nil,nil)
+	if err!=nil { return nil,err }
+	_,err = enc2.Write(clear)
+	if err!=nil { return nil,err }
+	err = enc2.Close()
+	if err!=nil { return nil,err }
+	err = enc1.Close()
+	if err!=nil { return nil,err }
+	buf.WriteString("\r\n")
+	return buf.Bytes(),nil
+}
+
+/*
+Builds a reply block over the chain of hops, ending at final. The replies
+arrive with the given subject.
+*/
+func NewReplyBlock(hops []Hop, final string, subject string) (rb *ReplyBlock,err error) {
+	if len(hops)==0 { err = ENoHops; return }
+	rb = &ReplyBlock{Remailer:hops[0].Address,Passphrases:make([]string,len(hops))}
+	for i := range hops {
+		rb.Passphrases[i],err = newPassphrase()
+		if err!=nil { rb = nil; return }
+	}
+	inner := []byte(fmt.Sprintf("Subject: %s\r\n\r\n",subject))
+	for i := len(hops)-1; i>=0; i-- {
+		next := final
+		if i+1<len(hops) { next = hops[i+1].Address }
+		clear := new(bytes.Buffer)
+		fmt.Fprintf(clear,"::\r\nAnon-To: %s\r\nEncrypt-Key: %s\r\n\r\n##\r\n",next,rb.Passphrases[i])
+		clear.Write(inner)
+		clear.WriteString("**\r\n")
+		layer,e := encryptLayer(clear.Bytes(),hops[i].Key)
+		if e!=nil { rb = nil; err = e; return }
+		if i==0 {
+			rb.Block = layer
+		} else {
+			inner = append([]byte(fmt.Sprintf("To: %s\r\nSubject: Anonymous Message.\r\n\r\n",hops[i].Address)),layer...)
+		}
+	}
+	return
+}
+
+/*
+Appends the text following the armored block to the cleartext. This is how
+the payload of a reply block is carried through the chain.
+*/
+func appendTrailer(cleartext []byte,blk *armor.Block,stream *bufio.Reader) ([]byte,error) {
+	_,err := io.Copy(ioutil.Discard,blk.Body) // Consume the END line.
+	if err!=nil { return nil,err }
+	rest,err := ioutil.ReadAll(stream)
+	if err!=nil { return nil,err }
+	return append(cleartext,rest...),nil
+}
+
+/*
+Removes the symmetric encryption layers from a reply. data is the reply
+message or its body.
+*/
+func (rb *ReplyBlock) Decrypt(data []byte) (payload []byte,err error) {
+	payload = data
+	for i := len(rb.Passphrases)-1; i>=0; i-- {
+		blk,e := armor.Decode(bytes.NewReader(payload))
+		if e!=nil { err = e; return }
+		if blk.Type!="PGP MESSAGE" { err = EInvalidArmor; return }
+		pass := []byte(rb.Passphrases[i])
+		tried := false
+		md,e := openpgp.ReadMessage(blk.Body,nil,func(keys []openpgp.Key, symmetric bool) ([]byte,error) {
+			if tried { return nil,pgperrs.ErrKeyIncorrect }
+			tried = true
+			return pass,nil
+		},nil)
+		if e!=nil { err = e; return }
+		payload,err = ioutil.ReadAll(md.UnverifiedBody)
+		if err!=nil { return }
+	}
+	return
+}
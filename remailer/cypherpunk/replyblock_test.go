@@ -0,0 +1,48 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package cypherpunk
+
+import "golang.org/x/crypto/openpgp"
+import "bytes"
+import "testing"
+
+func TestReplyBlock(t *testing.T) {
+	hops := []Hop{
+		{"r1@example.org",testKey(t,"r1@example.org")},
+		{"r2@example.org",testKey(t,"r2@example.org")},
+	}
+	rb,err := NewReplyBlock(hops,"nym@example.net","Reply to nym")
+	if err!=nil { t.Fatal(err) }
+	if rb.Remailer!="r1@example.org" || len(rb.Passphrases)!=2 { t.Fatal(rb.Remailer,rb.Passphrases) }
+	
+	// The replying party pastes the block, followed by the reply.
+	reply := "Subject: Re: hello\r\n\r\nthe reply\r\n"
+	msg := "To: r1@example.org\r\n\r\n"+string(rb.Block)+reply
+	
+	q1,err := ProcessMessage([]byte(msg),"r1@example.org",openpgp.EntityList{hops[0].Key})
+	if err!=nil { t.Fatal("hop 1:",err) }
+	if len(q1.To)!=1 || q1.To[0]!="r2@example.org" { t.Fatal("hop 1 sends to",q1.To) }
+	if bytes.Contains(q1.Body,[]byte("the reply")) { t.Fatal("plaintext after hop 1") }
+	
+	q2,err := ProcessMessage(q1.Body,"r2@example.org",openpgp.EntityList{hops[1].Key})
+	if err!=nil { t.Fatal("hop 2:",err) }
+	if len(q2.To)!=1 || q2.To[0]!="nym@example.net" { t.Fatal("hop 2 sends to",q2.To) }
+	h,_ := readHeader(t,q2.Body)
+	if h.Get("Subject")!="Reply to nym" { t.Fatalf("Subject %q",h.Get("Subject")) }
+	
+	payload,err := rb.Decrypt(q2.Body)
+	if err!=nil { t.Fatal(err) }
+	if string(payload)!=reply { t.Fatalf("payload %q",payload) }
+	
+	// The passphrases must be removed in order.
+	rb.Passphrases[0],rb.Passphrases[1] = rb.Passphrases[1],rb.Passphrases[0]
+	if _,err = rb.Decrypt(q2.Body); err==nil { t.Fatal("decrypted with swapped passphrases") }
+	
+	if _,err = NewReplyBlock(nil,"nym@example.net",""); err!=ENoHops { t.Fatal(err) }
+}
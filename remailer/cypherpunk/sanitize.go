@@ -0,0 +1,120 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package cypherpunk
+
+import "github.com/a-mail-group/ampp/qmodel"
+import "github.com/a-mail-group/ampp/crypto/boxpgp"
+import "bytes"
+import "crypto/rand"
+import "fmt"
+import "net/textproto"
+import "strings"
+import "time"
+
+/*
+Post-processes a message returned by ProcessMessage() before it is enqueued.
+*/
+type Filter interface{
+	Filter(qmsg *qmodel.Message) error
+}
+
+/*
+A filter that also handles control messages addressed to the remailer
+itself, such as block requests. Request() is called with the raw message
+before it is processed.
+*/
+type RequestFilter interface{
+	Filter
+	Request(msg []byte) (handled bool,err error)
+}
+
+/*
+The headers that Sanitizer keeps by default.
+*/
+var DefaultAllowedHeaders = []string{
+	"To",
+	"Cc",
+	"Subject",
+	"In-Reply-To",
+	"References",
+	"Newsgroups",
+	"Followup-To",
+	"Mime-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+	"Content-Disposition",
+	"Content-Language",
+}
+
+/*
+Strips identifying headers from exit messages. Only whitelisted headers are
+kept; From, Date and Message-Id are replaced.
+*/
+type Sanitizer struct{
+	// Header names to keep. If nil, DefaultAllowedHeaders is used.
+	Allowed []string
+
+	// The From header. If empty, the envelope sender (the remailer) is used.
+	From string
+
+	// If not empty, added as Comments header (the traditional remailer
+	// disclaimer).
+	Comments string
+
+	// If not empty, appended to plain text bodies.
+	Footer string
+}
+
+var _ Filter = (*Sanitizer)(nil)
+
+func newMessageId(from string) string {
+	domain := "localhost"
+	if i := strings.LastIndexByte(from,'@'); i>=0 { domain = strings.TrimRight(from[i+1:],">") }
+	var b [16]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("<%x@%s>",b,domain)
+}
+
+func (s *Sanitizer) Filter(qmsg *qmodel.Message) error {
+	allowed := s.Allowed
+	if allowed==nil { allowed = DefaultAllowedHeaders }
+	keep := make(map[string]bool)
+	for _,h := range allowed { keep[textproto.CanonicalMIMEHeaderKey(h)] = true }
+	for _,h := range []string{"From","Date","Message-Id","Comments"} { delete(keep,h) }
+
+	from := s.From
+	if from=="" { from = qmsg.From }
+
+	fields,body := boxpgp.SplitHeader(qmsg.Body)
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf,"From: %s\r\n",from)
+	fmt.Fprintf(buf,"Date: %s\r\n",time.Now().UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(buf,"Message-Id: %s\r\n",newMessageId(from))
+	if s.Comments!="" { fmt.Fprintf(buf,"Comments: %s\r\n",s.Comments) }
+	plain := true
+	for _,f := range fields {
+		if !keep[f.Name] { continue }
+		buf.Write(f.Lines)
+		v := strings.ToLower(string(f.Lines[bytes.IndexByte(f.Lines,':')+1:]))
+		switch f.Name {
+		case "Content-Type":
+			if !strings.Contains(v,"text/plain") { plain = false }
+		case "Content-Transfer-Encoding":
+			if strings.Contains(v,"base64") || strings.Contains(v,"quoted-printable") { plain = false }
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	if s.Footer!="" && plain {
+		if len(body)>0 && body[len(body)-1]!='\n' { buf.WriteString("\r\n") }
+		fmt.Fprintf(buf,"\r\n%s\r\n",s.Footer)
+	}
+	qmsg.Body = buf.Bytes()
+	return nil
+}
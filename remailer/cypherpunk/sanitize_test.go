@@ -0,0 +1,78 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package cypherpunk
+
+import "github.com/a-mail-group/ampp/qmodel"
+import "golang.org/x/crypto/openpgp"
+import "bufio"
+import "bytes"
+import _ "crypto/sha256"
+import "net/textproto"
+import "strings"
+import "testing"
+
+var testEntities = make(map[string]*openpgp.Entity)
+
+/*
+Returns a key pair for the given address, generated once per test binary.
+*/
+func testKey(t *testing.T,email string) *openpgp.Entity {
+	if e,ok := testEntities[email]; ok { return e }
+	e,err := openpgp.NewEntity("test","",email,nil)
+	if err!=nil { t.Fatal(err) }
+	for _,id := range e.Identities {
+		id.SelfSignature.PreferredHash = []uint8{8} // SHA-256
+		err = id.SelfSignature.SignUserId(id.UserId.Id,e.PrimaryKey,e.PrivateKey,nil)
+		if err!=nil { t.Fatal(err) }
+	}
+	testEntities[email] = e
+	return e
+}
+
+func readHeader(t *testing.T,msg []byte) (textproto.MIMEHeader,string) {
+	r := bufio.NewReader(bytes.NewReader(msg))
+	h,err := textproto.NewReader(r).ReadMIMEHeader()
+	if err!=nil { t.Fatal(err) }
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(r)
+	return h,buf.String()
+}
+
+func TestSanitizerRoundTrip(t *testing.T) {
+	key := testKey(t,"remailer@example.org")
+	orig := &qmodel.Message{
+		From: "alice@example.org",
+		To: []string{"bob@example.org"},
+		Body: []byte("Subject: hello\r\nX-Mailer: Leaky 1.0\r\nReceived: from alice.local by mx\r\n\tfor <bob@example.org>\r\nMessage-Id: <123@alice.local>\r\nDate: Mon, 1 Jan 2018 13:00:00 +0100\r\nContent-Type: text/plain\r\n\r\nsecret body\r\n"),
+	}
+	wrap,err := WrapMessageCypherpunk(orig,"remailer@example.org",key)
+	if err!=nil { t.Fatal(err) }
+	qmsg,err := ProcessMessage(wrap.Body,"remailer@example.org",openpgp.EntityList{key})
+	if err!=nil { t.Fatal(err) }
+	if len(qmsg.To)!=1 || qmsg.To[0]!="bob@example.org" { t.Fatalf("To %v",qmsg.To) }
+	
+	s := &Sanitizer{Comments:"This message was forwarded by an anonymous remailer.",Footer:"-- remailer"}
+	err = s.Filter(qmsg)
+	if err!=nil { t.Fatal(err) }
+	h,body := readHeader(t,qmsg.Body)
+	for _,leak := range []string{"X-Mailer","Received"} {
+		if h.Get(leak)!="" { t.Errorf("%s kept",leak) }
+	}
+	if h.Get("From")!="remailer@example.org" { t.Errorf("From %q",h.Get("From")) }
+	if id := h.Get("Message-Id"); id=="<123@alice.local>" || !strings.HasSuffix(id,"@example.org>") { t.Errorf("Message-Id %q",id) }
+	if d := h.Get("Date"); !strings.HasSuffix(d,"+0000") { t.Errorf("Date %q",d) }
+	if h.Get("Subject")!="hello" || h.Get("Content-Type")!="text/plain" { t.Errorf("allowed header dropped: %v",h) }
+	if h.Get("Comments")=="" { t.Error("Comments missing") }
+	if body!="secret body\r\n\r\n-- remailer\r\n" { t.Errorf("body %q",body) }
+	
+	// No footer for encoded bodies.
+	qmsg.Body = []byte("Content-Transfer-Encoding: base64\r\n\r\nc2VjcmV0\r\n")
+	s.Filter(qmsg)
+	if _,body = readHeader(t,qmsg.Body); body!="c2VjcmV0\r\n" { t.Errorf("footer added to encoded body %q",body) }
+}
@@ -48,7 +48,8 @@ restart:
 		if e!=nil { err = e; return }
 		nbody,e := ioutil.ReadAll(cleartext.UnverifiedBody)
 		if e!=nil { err = e; return }
-		body = nbody
+		body,err = appendTrailer(nbody,blk,stream)
+		if err!=nil { return }
 		goto restart
 	case "ZPGP":
 		blk,e := armor.Decode(stream)
@@ -60,7 +61,8 @@ restart:
 		nbody,e := ioutil.ReadAll(rc)
 		rc.Close()
 		if e!=nil { err = e; return }
-		body = nbody
+		body,err = appendTrailer(nbody,blk,stream)
+		if err!=nil { return }
 		goto restart
 	default:
 		err = EUnknownEncryption
@@ -73,18 +75,29 @@ restart:
 	
 	msg,e := ioutil.ReadAll(stream)
 	if e!=nil { err = e; return }
+	msg,e = reencrypt(h,msg)
+	if e!=nil { err = e; return }
 	
 	qmsg = &qmodel.Message{
 		From:myaddr,
 		To:h["Anon-To"],
 		Body:msg,
 	}
+	if post := h["Anon-Post-To"]; len(post)!=0 {
+		groups,e := parseNewsgroups(post)
+		if e!=nil { err = e; qmsg = nil; return }
+		qmsg.Newsgroups = groups
+		qmsg.Body = newsArticle(groups,myaddr,msg)
+	}
 	return
 }
 
 /*
 Processes a Message-Body that is assumed to be a Cypherpunk-Remailer message.
 It returns nil,ENotRemail if the message is not a Cypherpunk-Remailer message.
+
+If the message has an Anon-Post-To header, the result is a news article with
+qmsg.Newsgroups set. It must be routed using NewsGateway or posted by NNTP.
 */
 func ProcessMessage(msg []byte,myaddr string,ring openpgp.KeyRing) (qmsg *qmodel.Message,err error) {
 	stream := bufio.NewReader(bytes.NewReader(msg))
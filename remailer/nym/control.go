@@ -0,0 +1,123 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package nym
+
+import "golang.org/x/crypto/openpgp"
+import "golang.org/x/crypto/openpgp/clearsign"
+import "net/textproto"
+import "net/mail"
+import "bufio"
+import "bytes"
+import "errors"
+import "io"
+import "io/ioutil"
+import "strings"
+import "time"
+
+var (
+	EBadControl = errors.New("Invalid control message")
+	EBadSignature = errors.New("Control message not signed by the nym key")
+	EReplay = errors.New("Control message is not newer than the last one")
+)
+
+/*
+A control message. It is sent to the control address as a clear-signed
+message of the form
+
+	Action: create | update | delete
+	Nym: <name>
+	Date: <RFC 5322 date>
+	Remailer: <first hop of the reply block>
+	
+	<reply block>
+
+The message must be signed by the key of the nym. For "create", the public
+key is attached as an armored key block after the signed message.
+*/
+type Control struct{
+	Action string
+	Name string
+	Date time.Time
+	Remailer string
+	ReplyBlock []byte
+	
+	// For "create".
+	Key *openpgp.Entity
+	
+	signed *clearsign.Block
+}
+
+/*
+Parses a control message. The signature is not checked.
+*/
+func ParseControl(data []byte) (c *Control,err error) {
+	b,rest := clearsign.Decode(data)
+	if b==nil { err = EBadControl; return }
+	r := bufio.NewReader(bytes.NewReader(b.Bytes))
+	// The signed text of a delete request ends without an empty line.
+	h,e := textproto.NewReader(r).ReadMIMEHeader()
+	if e!=nil && (e!=io.EOF || len(h)==0) { err = EBadControl; return }
+	c = &Control{
+		Action: strings.ToLower(strings.TrimSpace(h.Get("Action"))),
+		Remailer: strings.TrimSpace(h.Get("Remailer")),
+		signed: b,
+	}
+	c.Name,err = normalizeName(h.Get("Nym"))
+	if err!=nil { c = nil; return }
+	c.Date,e = mail.ParseDate(h.Get("Date"))
+	if e!=nil { c = nil; err = EBadControl; return }
+	c.ReplyBlock,_ = ioutil.ReadAll(r)
+	switch c.Action {
+	case "create":
+		el,e := openpgp.ReadArmoredKeyRing(bytes.NewReader(rest))
+		if e!=nil || len(el)!=1 { c = nil; err = EBadControl; return }
+		c.Key = el[0]
+		fallthrough
+	case "update":
+		if c.Remailer=="" || len(c.ReplyBlock)==0 { c = nil; err = EBadControl; return }
+	case "delete":
+	default:
+		c = nil; err = EBadControl
+	}
+	return
+}
+
+/*
+Checks that the control message is signed by key.
+*/
+func (c *Control) verify(key *openpgp.Entity) error {
+	_,err := openpgp.CheckDetachedSignature(openpgp.EntityList{key},bytes.NewReader(c.signed.Bytes),c.signed.ArmoredSignature.Body)
+	if err!=nil { return EBadSignature }
+	return nil
+}
+
+/*
+Verifies and applies a control message.
+*/
+func (s *Store) Apply(c *Control) error {
+	if c.Action=="create" {
+		err := c.verify(c.Key)
+		if err!=nil { return err }
+		key,err := serializeKey(c.Key)
+		if err!=nil { return err }
+		return s.Put(&Nym{c.Name,key,c.Remailer,c.ReplyBlock,time.Now(),c.Date},true)
+	}
+	n,err := s.Get(c.Name)
+	if err!=nil { return err }
+	e,err := n.Entity()
+	if err!=nil { return err }
+	err = c.verify(e)
+	if err!=nil { return err }
+	if !c.Date.After(n.Updated) { return EReplay }
+	if c.Action=="delete" { return s.Delete(n.Name) }
+	n.Remailer = c.Remailer
+	n.ReplyBlock = c.ReplyBlock
+	n.Updated = c.Date
+	return s.Put(n,false)
+}
@@ -0,0 +1,119 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+/*
+Nym server. A nym is a pseudonym address with a public key and a reply block.
+Mail to the nym is encrypted to the key and sent through the reply block, so
+that the owner can receive replies without revealing their address.
+*/
+package nym
+
+import "golang.org/x/crypto/openpgp"
+import "golang.org/x/crypto/openpgp/packet"
+import bolt "github.com/coreos/bbolt"
+import "github.com/vmihailenco/msgpack"
+import "bytes"
+import "errors"
+import "regexp"
+import "strings"
+import "time"
+
+var (
+	ENoNym = errors.New("No such nym")
+	ENymExists = errors.New("Nym already exists")
+	EBadName = errors.New("Invalid nym name")
+)
+
+var bNyms = []byte("nyms")
+
+var r_name = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+type Nym struct{
+	Name string
+	
+	// The serialized public key of the owner. Control messages must be signed
+	// by it, and mail is encrypted to it.
+	Key []byte
+	
+	// The address of the first remailer in the chain, and the reply block
+	// that is prepended to the encrypted mail.
+	Remailer string
+	ReplyBlock []byte
+	
+	Created time.Time
+	
+	// The Date of the last accepted control message.
+	Updated time.Time
+}
+
+/*
+Parses the public key of the nym.
+*/
+func (n *Nym) Entity() (*openpgp.Entity,error) {
+	return openpgp.ReadEntity(packet.NewReader(bytes.NewReader(n.Key)))
+}
+
+/*
+Normalizes and validates a nym name.
+*/
+func normalizeName(name string) (string,error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !r_name.MatchString(name) { return "",EBadName }
+	return name,nil
+}
+
+func serializeKey(e *openpgp.Entity) ([]byte,error) {
+	buf := new(bytes.Buffer)
+	err := e.Serialize(buf)
+	if err!=nil { return nil,err }
+	return buf.Bytes(),nil
+}
+
+/*
+The nym database.
+*/
+type Store struct{
+	DB *bolt.DB
+}
+
+func (s *Store) Get(name string) (n *Nym,err error) {
+	name,err = normalizeName(name)
+	if err!=nil { return }
+	err = s.DB.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bNyms)
+		if bkt==nil { return ENoNym }
+		v := bkt.Get([]byte(name))
+		if v==nil { return ENoNym }
+		n = new(Nym)
+		return msgpack.Unmarshal(v,n)
+	})
+	if err!=nil { n = nil }
+	return
+}
+
+/*
+Stores a nym. If create is set, the nym must not exist yet.
+*/
+func (s *Store) Put(n *Nym, create bool) error {
+	data,err := msgpack.Marshal(n)
+	if err!=nil { return err }
+	return s.DB.Batch(func(tx *bolt.Tx) error {
+		bkt,err := tx.CreateBucketIfNotExists(bNyms)
+		if err!=nil { return err }
+		if create && bkt.Get([]byte(n.Name))!=nil { return ENymExists }
+		return bkt.Put([]byte(n.Name),data)
+	})
+}
+
+func (s *Store) Delete(name string) error {
+	return s.DB.Batch(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bNyms)
+		if bkt==nil || bkt.Get([]byte(name))==nil { return ENoNym }
+		return bkt.Delete([]byte(name))
+	})
+}
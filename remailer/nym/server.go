@@ -0,0 +1,122 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package nym
+
+import "github.com/a-mail-group/ampp/crypto/boxpgp"
+import "github.com/a-mail-group/ampp/qmodel"
+import "github.com/a-mail-group/ampp/queue"
+import "golang.org/x/crypto/openpgp"
+import "bytes"
+import "fmt"
+import "io"
+import "strings"
+
+/*
+Processes the mail for the nyms and the control address. Incoming mail is
+read from the queue N (filled by a *smtpio.Input), outgoing mail is enqueued
+into Out.
+
+Store must not use the database of Q, as it is updated from within the
+queue transaction.
+*/
+type Server struct{
+	Store *Store
+	
+	Q *queue.Queue
+	N string
+	Out string
+	
+	// Nyms are <name>@Domain.
+	Domain string
+	
+	// The control address. Also the sender of the outgoing mail.
+	Address string
+}
+
+func trimAddress(addr string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(addr),"<"),">"))
+}
+
+/*
+Encrypts a message to the nym and wraps it into the reply block.
+*/
+func (s *Server) reply(n *Nym, m *qmodel.Message) (*qmodel.Message,error) {
+	e,err := n.Entity()
+	if err!=nil { return nil,err }
+	payload,err := boxpgp.EncryptMessage(m.Body,[]*openpgp.Entity{e})
+	if err!=nil { return nil,err }
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf,"To: %s\r\nFrom: %s\r\nSubject: Anonymous Message.\r\n\r\n",n.Remailer,s.Address)
+	buf.Write(n.ReplyBlock)
+	if len(n.ReplyBlock)>0 && n.ReplyBlock[len(n.ReplyBlock)-1]!='\n' { buf.WriteString("\r\n") }
+	buf.Write(payload)
+	return &qmodel.Message{From:s.Address,To:[]string{n.Remailer},Body:buf.Bytes()},nil
+}
+
+/*
+Handles one recipient of an incoming message.
+*/
+func (s *Server) handle(tx *queue.Tx, rcpt string, m *qmodel.Message) error {
+	rcpt = trimAddress(rcpt)
+	if rcpt==trimAddress(s.Address) {
+		c,err := ParseControl(m.Body)
+		if err!=nil { return err }
+		return s.Store.Apply(c)
+	}
+	i := strings.LastIndexByte(rcpt,'@')
+	if i<0 || rcpt[i+1:]!=strings.ToLower(s.Domain) { return ENoNym }
+	n,err := s.Store.Get(rcpt[:i])
+	if err!=nil { return err }
+	out,err := s.reply(n,m)
+	if err!=nil { return err }
+	return tx.EnqueueMessage(s.Out,out)
+}
+
+/*
+Reports, whether an error returned by handle() is permanent: the message
+is invalid or the nym does not exist. Other errors, such as failures of the
+databases, are transient.
+*/
+func permanent(err error) bool {
+	switch err {
+	case ENoNym,ENymExists,EBadName,EBadControl,EBadSignature,EReplay: return true
+	}
+	return boxpgp.IsKeyError(err) || boxpgp.IsStructuralError(err)
+}
+
+/*
+Processes the queued incoming mail. Recipients failing permanently are
+dropped. On a transient failure, the message is kept with the recipients
+that have not been handled yet, processing stops and the error is returned.
+*/
+func (s *Server) Process() (err error) {
+	e := s.Q.Process(func(tx *queue.Tx) error {
+		f := tx.Fetch(s.N)
+		keys := make([][]byte,0,1024)
+	loop:
+		for {
+			k,m,e := f.Next()
+			if e==io.EOF { break }
+			if e!=nil { keys = append(keys,k); continue } // XXX ignores broken messages.
+			for i,rcpt := range m.To {
+				e = s.handle(tx,rcpt,m)
+				if e==nil || permanent(e) { continue }
+				err = e
+				m.To = m.To[i:]
+				e = tx.ReEnqueueMessage(k,s.N,m)
+				if e!=nil { return e }
+				break loop
+			}
+			keys = append(keys,k)
+		}
+		return tx.RemoveAll(s.N,keys)
+	})
+	if e!=nil { err = e }
+	return
+}
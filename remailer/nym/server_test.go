@@ -0,0 +1,108 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package nym
+
+import "github.com/a-mail-group/ampp/qmodel"
+import "github.com/a-mail-group/ampp/queue"
+import "golang.org/x/crypto/openpgp"
+import "golang.org/x/crypto/openpgp/armor"
+import "golang.org/x/crypto/openpgp/clearsign"
+import bolt "github.com/coreos/bbolt"
+import "bytes"
+import _ "crypto/sha256"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func testKey(t *testing.T,email string) *openpgp.Entity {
+	e,err := openpgp.NewEntity("test","",email,nil)
+	if err!=nil { t.Fatal(err) }
+	for _,id := range e.Identities {
+		id.SelfSignature.PreferredHash = []uint8{8} // SHA-256
+		err = id.SelfSignature.SignUserId(id.UserId.Id,e.PrimaryKey,e.PrivateKey,nil)
+		if err!=nil { t.Fatal(err) }
+	}
+	return e
+}
+
+func createControl(t *testing.T,e *openpgp.Entity,name string) []byte {
+	buf := new(bytes.Buffer)
+	w,err := clearsign.Encode(buf,e.PrivateKey,nil)
+	if err!=nil { t.Fatal(err) }
+	fmt.Fprintf(w,"Action: create\r\nNym: %s\r\nDate: %s\r\nRemailer: remailer@example.org\r\n\r\n::\r\nAnon-To: %s@example.net\r\n",
+		name,time.Now().Format(time.RFC1123Z),name)
+	err = w.Close()
+	if err!=nil { t.Fatal(err) }
+	buf.WriteString("\r\n")
+	kw,err := armor.Encode(buf,openpgp.PublicKeyType,nil)
+	if err!=nil { t.Fatal(err) }
+	err = e.Serialize(kw)
+	if err!=nil { t.Fatal(err) }
+	kw.Close()
+	return buf.Bytes()
+}
+
+func countQueue(t *testing.T,q *queue.Queue,name string) (n int) {
+	err := q.Process(func(tx *queue.Tx) error {
+		f := tx.Fetch(name)
+		for {
+			_,_,err := f.Next()
+			if err!=nil { return nil }
+			n++
+		}
+	})
+	if err!=nil { t.Fatal(err) }
+	return
+}
+
+func TestServerProcess(t *testing.T) {
+	dir,err := ioutil.TempDir("","nym")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	q,err := queue.Open(filepath.Join(dir,"queue.db"))
+	if err!=nil { t.Fatal(err) }
+	defer q.Close()
+	openStore := func() *bolt.DB {
+		db,err := bolt.Open(filepath.Join(dir,"nyms.db"),0600,nil)
+		if err!=nil { t.Fatal(err) }
+		return db
+	}
+	db := openStore()
+	s := &Server{Store:&Store{db},Q:q,N:"in",Out:"out",Domain:"nym.example.org",Address:"config@nym.example.org"}
+	enqueue := func(to []string,body []byte) {
+		err := q.EnqueueMessage("in",&qmodel.Message{From:"x@example.org",To:to,Body:body})
+		if err!=nil { t.Fatal(err) }
+		time.Sleep(time.Millisecond) // Distinct keys.
+	}
+	
+	enqueue([]string{"<config@nym.example.org>"},createControl(t,testKey(t,"alice@example.net"),"alice"))
+	enqueue([]string{"nobody@nym.example.org","alice@nym.example.org"},[]byte("Subject: hi\r\n\r\nhello\r\n"))
+	err = s.Process()
+	if err!=nil { t.Fatal(err) }
+	if _,err = s.Store.Get("alice"); err!=nil { t.Fatal("nym not created:",err) }
+	if n := countQueue(t,q,"out"); n!=1 { t.Fatalf("%d replies",n) }
+	if n := countQueue(t,q,"in"); n!=0 { t.Fatalf("%d messages left",n) }
+	
+	// A transient failure keeps the message.
+	db.Close()
+	enqueue([]string{"alice@nym.example.org"},[]byte("Subject: again\r\n\r\nhello\r\n"))
+	if err = s.Process(); err==nil { t.Fatal("no error with a closed store") }
+	if n := countQueue(t,q,"in"); n!=1 { t.Fatalf("%d messages left",n) }
+	
+	db = openStore()
+	defer db.Close()
+	s.Store.DB = db
+	err = s.Process()
+	if err!=nil { t.Fatal(err) }
+	if n := countQueue(t,q,"out"); n!=2 { t.Fatalf("%d replies",n) }
+	if n := countQueue(t,q,"in"); n!=0 { t.Fatalf("%d messages left",n) }
+}
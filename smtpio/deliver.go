@@ -0,0 +1,297 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package smtpio
+
+import "github.com/emersion/go-smtp"
+import "github.com/a-mail-group/ampp/qmodel"
+import "net/textproto"
+import "bytes"
+import "fmt"
+import "time"
+
+const defaultChunkSize = 1<<16
+
+var (
+	ENeedSMTPUTF8 = &smtp.SMTPError{Code:553, Message:"5.6.7 Destination does not support SMTPUTF8, address or header requires it"}
+	ENeedBinary = &smtp.SMTPError{Code:554, Message:"5.6.3 Destination does not support BINARYMIME, message contains binary data"}
+	ENeed8BitMIME = &smtp.SMTPError{Code:554, Message:"5.6.3 Destination does not support 8BITMIME, message contains 8-bit data"}
+)
+
+// A recipient that was rejected by the peer.
+type rcptError struct{
+	Rcpt string
+	Err  error
+}
+
+/*
+The encoding needs of a stored message.
+*/
+type bodyNeeds struct{
+	smtputf8  bool // Non-ASCII addresses or headers.
+	eightbit  bool // 8-bit body.
+	binary    bool // NUL bytes.
+	longlines bool // Lines longer than 998 octets.
+}
+
+func isASCII(s string) bool {
+	for i := 0; i<len(s); i++ {
+		if s[i]>=0x80 { return false }
+	}
+	return true
+}
+
+func analyzeMessage(m *qmodel.Message) (n bodyNeeds) {
+	n.smtputf8 = !isASCII(m.From)
+	for _,to := range m.To {
+		if !isASCII(to) { n.smtputf8 = true }
+	}
+	inHeader := true
+	start := 0 // Of the current line.
+	for i,b := range m.Body {
+		switch {
+		case b==0:
+			n.binary = true
+		case b>=0x80:
+			n.eightbit = true
+			if inHeader { n.smtputf8 = true }
+		case b=='\n':
+			end := i
+			if end>start && m.Body[end-1]=='\r' { end-- }
+			if inHeader && end==start { inHeader = false }
+			if end-start>998 { n.longlines = true }
+			start = i+1
+		}
+	}
+	if len(m.Body)-start>998 { n.longlines = true }
+	return
+}
+
+/*
+Converts bare LF and bare CR into CRLF, as required by the BDAT command for
+non-binary messages.
+*/
+func canonicalCRLF(b []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.Grow(len(b)+len(b)/32)
+	for i,c := range b {
+		switch c {
+		case '\r':
+			buf.WriteString("\r\n")
+		case '\n':
+			if i==0 || b[i-1]!='\r' { buf.WriteString("\r\n") }
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.Bytes()
+}
+
+/*
+Reports, whether an error is a permanent (5xx) SMTP failure.
+*/
+func isPermanent(err error) bool {
+	switch v := err.(type) {
+	case *textproto.Error: return v.Code>=500
+	case *smtp.SMTPError: return v.Code>=500
+	}
+	return false
+}
+
+/*
+Reports, whether an error is a SMTP reply (rather than a network error).
+*/
+func isReply(err error) bool {
+	switch err.(type) {
+	case *textproto.Error,*smtp.SMTPError: return true
+	}
+	return false
+}
+
+/*
+Performs one mail transaction on an established connection. It uses
+PIPELINING for the envelope, BDAT if CHUNKING is offered and the body is
+large or binary, and passes the SMTPUTF8 and BODY= parameters when the
+message needs them. If the peer lacks an extension the message needs, the
+message fails permanently (ENeedSMTPUTF8, ENeed8BitMIME, ENeedBinary), so
+that the sender receives a DSN.
+
+The returned slice contains the recipients that were rejected, either
+permanently or temporarily. If every recipient was rejected, no message is
+transferred and err is nil. If err is a permanent failure, the whole message
+failed permanently.
+*/
+func deliver(c *smtp.Client, m *qmodel.Message, chunkSize int) (rejected []rcptError, err error) {
+	if chunkSize<=0 { chunkSize = defaultChunkSize }
+	n := analyzeMessage(m)
+	pipelining,_ := c.Extension("PIPELINING")
+	chunking,_ := c.Extension("CHUNKING")
+	utf8ok,_ := c.Extension("SMTPUTF8")
+	eightok,_ := c.Extension("8BITMIME")
+	binaryok,_ := c.Extension("BINARYMIME")
+	sizeok,_ := c.Extension("SIZE")
+
+	if n.smtputf8 && !utf8ok { err = ENeedSMTPUTF8; return }
+
+	// BDAT carries NUL bytes and overlong lines unmodified. Without CHUNKING,
+	// overlong lines are sent with DATA, leaving it to the peer to accept
+	// them, as many do.
+	raw := n.binary || (n.longlines && chunking)
+	useBdat := chunking && (raw || len(m.Body)>chunkSize)
+	params := ""
+	switch {
+	case raw && chunking && binaryok:
+		params += " BODY=BINARYMIME"
+	case n.eightbit && !eightok:
+		// The body is not downconverted: that would mean re-encoding the MIME
+		// structure of a message, that may be signed.
+		err = ENeed8BitMIME
+		return
+	case raw && chunking:
+		// Without BINARYMIME, BDAT still carries the body unmodified.
+		if eightok { params += " BODY=8BITMIME" }
+	case raw:
+		// DATA would mangle NUL bytes.
+		err = ENeedBinary
+		return
+	case n.eightbit && eightok:
+		params += " BODY=8BITMIME"
+	}
+	if n.smtputf8 { params += " SMTPUTF8" }
+	if sizeok { params += fmt.Sprintf(" SIZE=%d",len(m.Body)) }
+
+	text := c.Text
+	if pipelining {
+		// Send the whole envelope at once, then collect the replies.
+		err = text.PrintfLine("MAIL FROM:<%s>%s",m.From,params)
+		if err!=nil { return }
+		for _,to := range m.To {
+			err = text.PrintfLine("RCPT TO:<%s>",to)
+			if err!=nil { return }
+		}
+		_,_,err = text.ReadResponse(25)
+		if err!=nil {
+			// Drain the RCPT replies to keep the connection in sync.
+			for range m.To { text.ReadResponse(25) }
+			return
+		}
+		for _,to := range m.To {
+			_,_,e := text.ReadResponse(25)
+			if e!=nil {
+				if !isReply(e) { err = e; return }
+				rejected = append(rejected,rcptError{to,e})
+			}
+		}
+	} else {
+		_,_,err = cmd(text,25,"MAIL FROM:<%s>%s",m.From,params)
+		if err!=nil { return }
+		for _,to := range m.To {
+			_,_,e := cmd(text,25,"RCPT TO:<%s>",to)
+			if e!=nil {
+				if !isReply(e) { err = e; return }
+				rejected = append(rejected,rcptError{to,e})
+			}
+		}
+	}
+	if len(rejected)==len(m.To) {
+		err = c.Reset()
+		return
+	}
+
+	if useBdat {
+		body := m.Body
+		if !raw { body = canonicalCRLF(body) }
+		for {
+			chunk := body
+			if len(chunk)>chunkSize { chunk = chunk[:chunkSize] }
+			body = body[len(chunk):]
+			last := ""
+			if len(body)==0 { last = " LAST" }
+			err = text.PrintfLine("BDAT %d%s",len(chunk),last)
+			if err!=nil { return }
+			_,err = text.W.Write(chunk)
+			if err!=nil { return }
+			err = text.W.Flush()
+			if err!=nil { return }
+			_,_,err = text.ReadResponse(25)
+			if err!=nil { return }
+			if len(body)==0 { break }
+		}
+		return
+	}
+
+	w,err := c.Data()
+	if err!=nil { return }
+	_,err = w.Write(m.Body)
+	if err!=nil { return }
+	err = w.Close()
+	return
+}
+
+func cmd(text *textproto.Conn, expectCode int, format string, args ...interface{}) (int, string, error) {
+	id,err := text.Cmd(format,args...)
+	if err!=nil { return 0,"",err }
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	return text.ReadResponse(expectCode)
+}
+
+/*
+Extracts the enhanced status code (RFC 3463) from a SMTP error.
+*/
+func statusOf(err error) string {
+	var msg string
+	var code int
+	switch v := err.(type) {
+	case *textproto.Error: code,msg = v.Code,v.Msg
+	case *smtp.SMTPError: code,msg = v.Code,v.Message
+	}
+	if len(msg)>=5 && msg[1]=='.' && (msg[0]=='4' || msg[0]=='5') {
+		if i := bytes.IndexByte([]byte(msg),' '); i>0 { return msg[:i] }
+	}
+	if code>=400 && code<500 { return "4.0.0" }
+	return "5.0.0"
+}
+
+/*
+Creates a delivery status notification (RFC 3464) for recipients that
+failed permanently.
+*/
+func makeDSN(reporter string, m *qmodel.Message, rcpts []rcptError) *qmodel.Message {
+	boundary := fmt.Sprintf("dsn-%x",time.Now().UnixNano())
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf,"From: Mail Delivery System <MAILER-DAEMON@%s>\r\n",reporter)
+	fmt.Fprintf(buf,"To: <%s>\r\n",m.From)
+	fmt.Fprintf(buf,"Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(buf,"Date: %s\r\n",time.Now().UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(buf,"Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(buf,"MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf,"Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n",boundary)
+	fmt.Fprintf(buf,"\r\n--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n",boundary)
+	fmt.Fprintf(buf,"Your message could not be delivered to the following recipients:\r\n\r\n")
+	for _,r := range rcpts {
+		fmt.Fprintf(buf,"<%s>: %v\r\n",r.Rcpt,r.Err)
+	}
+	fmt.Fprintf(buf,"\r\n--%s\r\nContent-Type: message/delivery-status\r\n\r\n",boundary)
+	fmt.Fprintf(buf,"Reporting-MTA: dns; %s\r\n",reporter)
+	for _,r := range rcpts {
+		fmt.Fprintf(buf,"\r\nFinal-Recipient: rfc822; %s\r\nAction: failed\r\nStatus: %s\r\nDiagnostic-Code: smtp; %v\r\n",r.Rcpt,statusOf(r.Err),r.Err)
+	}
+	fmt.Fprintf(buf,"\r\n--%s\r\nContent-Type: text/rfc822-headers\r\n\r\n",boundary)
+	hend := bytes.Index(m.Body,[]byte("\r\n\r\n"))
+	if hend<0 { hend = bytes.Index(m.Body,[]byte("\n\n")) }
+	if hend>=0 { buf.Write(m.Body[:hend]); buf.WriteString("\r\n") }
+	fmt.Fprintf(buf,"\r\n--%s--\r\n",boundary)
+
+	return &qmodel.Message{
+		From: "",
+		To: []string{m.From},
+		Body: buf.Bytes(),
+	}
+}
@@ -0,0 +1,32 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package smtpio
+
+import "github.com/a-mail-group/ampp/qmodel"
+import "strings"
+import "testing"
+
+func TestAnalyzeMessage(t *testing.T) {
+	long := func(n int,eol string) string { return "Subject: x\r\n\r\n"+strings.Repeat("a",n)+eol }
+	for _,c := range []struct{ body string; want bodyNeeds }{
+		{long(998,"\n"),bodyNeeds{}},
+		{long(999,"\n"),bodyNeeds{longlines:true}},
+		{long(998,"\r\n"),bodyNeeds{}},
+		{long(999,"\r\n"),bodyNeeds{longlines:true}},
+		{long(999,""),bodyNeeds{longlines:true}},
+		{"Subject: x\r\n\r\nGr\xc3\xbc\xc3\x9fe\r\n",bodyNeeds{eightbit:true}},
+		{"Subject: Gr\xc3\xbc\xc3\x9fe\r\n\r\nbody\r\n",bodyNeeds{eightbit:true,smtputf8:true}},
+		{"Subject: x\n\nGr\xc3\xbc\xc3\x9fe\n",bodyNeeds{eightbit:true}},
+		{"Subject: x\r\n\r\na\x00b\r\n",bodyNeeds{binary:true}},
+	} {
+		got := analyzeMessage(&qmodel.Message{From:"a@example.org",To:[]string{"b@example.org"},Body:[]byte(c.body)})
+		if got!=c.want { t.Errorf("%.40q: %+v, want %+v",c.body,got,c.want) }
+	}
+	if n := analyzeMessage(&qmodel.Message{To:[]string{"b\xc3\xbc@example.org"}}); !n.smtputf8 { t.Error("non-ASCII recipient") }
+}
@@ -12,11 +12,12 @@ package smtpio
 import "github.com/emersion/go-smtp"
 import "github.com/emersion/go-sasl"
 
-//import "github.com/a-mail-group/ampp/qmodel"
+import "github.com/a-mail-group/ampp/qmodel"
 import "github.com/a-mail-group/ampp/queue"
+import "github.com/a-mail-group/ampp/dialer"
 import "io"
-import "bytes"
-import "crypto/tls"
+import "net"
+import "strconv"
 
 type Input struct{
 	Q *queue.Queue
@@ -38,63 +39,123 @@ var _ smtp.User = (*Input)(nil)
 type Output struct{
 	Q *queue.Queue
 	N string
+	
+	// Maximum size of a BDAT chunk. Messages larger than this are sent
+	// using BDAT if the peer supports CHUNKING. Zero means 64 KiB.
+	ChunkSize int
+	
+	// If not empty, delivery status notifications for permanently failed
+	// messages are enqueued into this queue. Otherwise they are dropped.
+	DSN string
+	
+	// The host name used as Reporting-MTA in delivery status notifications.
+	Domain string
+	
+	// TLS policies by destination host name. If no policy exists for a host,
+	// DefaultTLS is used. A nil policy means TLSOpportunistic.
+	TLS map[string]*TLSPolicy
+	DefaultTLS *TLSPolicy
+	
+	// Used to connect to the SMTP servers. nil means direct.
+	Dialer dialer.Dialer
 }
 
-func (i *Output) ProcessSimple(addr string, a sasl.Client) error {
-	return i.Q.Process(func(tx *queue.Tx) error {
-		f := tx.Fetch(i.N)
-		keys := make([][]byte,1024)
-		for {
-			k,m,e := f.Next()
-			if e==io.EOF { break }
-			if e!=nil { keys = append(keys,k); continue } // XXX ignores broken messages.
-			e = smtp.SendMail(addr,a,m.From,m.To,bytes.NewReader(m.Body))
-			if e!=nil { break } // Network errors.
-			keys = append(keys,k)
-			if len(keys)>=1024 {
-				tx.RemoveAll(i.N,keys) // XXX ignore errors!
-				keys = keys[:0]
-			}
+func (i *Output) tlsPolicy(hostname string) *TLSPolicy {
+	if p,ok := i.TLS[hostname]; ok { return p }
+	return i.DefaultTLS
+}
+
+/*
+Connects to a SMTP server, negotiates TLS according to the policy of the
+destination and authenticates.
+*/
+func (i *Output) dial(hostname string,addr string, a sasl.Client) (*smtp.Client,error) {
+	_,ports,err := net.SplitHostPort(addr)
+	if err!=nil { return nil,err }
+	port,_ := strconv.Atoi(ports)
+	conn,err := dialer.Or(i.Dialer).Dial("tcp",addr)
+	if err!=nil { return nil,err }
+	c,err := smtp.NewClient(conn,hostname)
+	if err!=nil { conn.Close(); return nil,err }
+	err = i.tlsPolicy(hostname).apply(c,hostname,port)
+	if err!=nil { c.Close(); return nil,err }
+	if ok, _ := c.Extension("AUTH"); ok && a!=nil {
+		if err = c.Auth(a); err != nil {
+			c.Close()
+			return nil,err
 		}
-		tx.RemoveAll(i.N,keys) // XXX ignore errors!
-		return nil
-	})
+	}
+	return c,nil
 }
 
-func (i *Output) ProcessFast(hostname string,addr string, a sasl.Client) error {
-	c,err := smtp.Dial(addr)
-	if err!=nil { return err }
+/*
+Like smtp.SendMail, but enforces the TLS policy and uses the extensions of
+the peer (see deliver).
+*/
+func (i *Output) sendMail(addr string, a sasl.Client, m *qmodel.Message) (rejected []rcptError, err error) {
+	hostname,_,err := net.SplitHostPort(addr)
+	if err!=nil { return }
+	c,err := i.dial(hostname,addr,a)
+	if err!=nil { return }
 	defer c.Close()
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		config := &tls.Config{ServerName: hostname}
-		if err = c.StartTLS(config); err != nil {
-			return err
+	rejected,err = deliver(c,m,i.ChunkSize)
+	if err!=nil { return }
+	c.Quit() // The message has been accepted.
+	return
+}
+
+/*
+Splits the rejected recipients of a message into permanent failures, that are
+reported in a DSN, and temporary failures, that are returned as a new message
+to be retried. If the DSN can not be enqueued, the permanently failed
+recipients are retried as well, so that they are reported later.
+*/
+func (i *Output) bounce(tx *queue.Tx, m *qmodel.Message, rej []rcptError) (retry *qmodel.Message,err error) {
+	var failed []rcptError
+	for _,r := range rej {
+		if isPermanent(r.Err) {
+			failed = append(failed,r)
+		} else {
+			if retry==nil { retry = &qmodel.Message{From:m.From,Body:m.Body} }
+			retry.To = append(retry.To,r.Rcpt)
 		}
 	}
-	if ok, _ := c.Extension("AUTH"); ok && a!=nil {
-		if err = c.Auth(a); err != nil {
-			return err
-		}
+	if i.DSN=="" || m.From=="" || len(failed)==0 { return } // Never bounce a bounce.
+	domain := i.Domain
+	if domain=="" { domain = "localhost" }
+	err = tx.EnqueueMessage(i.DSN,makeDSN(domain,m,failed))
+	if err!=nil {
+		if retry==nil { retry = &qmodel.Message{From:m.From,Body:m.Body} }
+		for _,r := range failed { retry.To = append(retry.To,r.Rcpt) }
 	}
-	return i.Q.Process(func(tx *queue.Tx) error {
+	return
+}
+
+/*
+Delivers the queued messages using send, until a network error or a
+temporary failure of a whole message occurs. Errors of the queue, that
+occur after messages have been delivered, are returned after the transaction
+has been committed, so that the messages are not delivered twice.
+*/
+func (i *Output) process(send func(m *qmodel.Message) ([]rcptError,error)) error {
+	var qerr error
+	err := i.Q.Process(func(tx *queue.Tx) error {
 		f := tx.Fetch(i.N)
-		keys := make([][]byte,1024)
+		keys := make([][]byte,0,1024)
+		var retries []*qmodel.Message
 		for {
 			k,m,e := f.Next()
 			if e==io.EOF { break }
 			if e!=nil { keys = append(keys,k); continue } // XXX ignores broken messages.
-			e = c.Mail(m.From)
-			if e!=nil { break }
-			for _,to := range m.To {
-				e = c.Rcpt(to)
-				if e!=nil { break }
+			rej,e := send(m)
+			if e!=nil {
+				if !isPermanent(e) { break } // Network errors and temporary failures.
+				rej = rej[:0]
+				for _,to := range m.To { rej = append(rej,rcptError{to,e}) }
 			}
-			w,e := c.Data()
-			if e!=nil { break }
-			_,e = w.Write(m.Body)
-			if e!=nil { break }
-			e = w.Close()
-			if e!=nil { break }
+			retry,e := i.bounce(tx,m,rej)
+			if e!=nil && qerr==nil { qerr = e }
+			if retry!=nil { retries = append(retries,retry) }
 			keys = append(keys,k)
 			if len(keys)>=1024 {
 				tx.RemoveAll(i.N,keys) // XXX ignore errors!
@@ -102,8 +163,37 @@ func (i *Output) ProcessFast(hostname string,addr string, a sasl.Client) error {
 			}
 		}
 		tx.RemoveAll(i.N,keys) // XXX ignore errors!
-		c.Quit()
+		for _,m := range retries {
+			e := tx.EnqueueMessage(i.N,m)
+			if e!=nil && qerr==nil { qerr = e }
+		}
 		return nil
 	})
+	if err==nil { err = qerr }
+	return err
 }
 
+/*
+Delivers every message over its own connection.
+*/
+func (i *Output) ProcessSimple(addr string, a sasl.Client) error {
+	return i.process(func(m *qmodel.Message) ([]rcptError,error) {
+		return i.sendMail(addr,a,m)
+	})
+}
+
+/*
+Delivers the messages over a single connection.
+*/
+func (i *Output) ProcessFast(hostname string,addr string, a sasl.Client) error {
+	c,err := i.dial(hostname,addr,a)
+	if err!=nil { return err }
+	defer c.Close()
+	err = i.process(func(m *qmodel.Message) ([]rcptError,error) {
+		rej,e := deliver(c,m,i.ChunkSize)
+		if isPermanent(e) { c.Reset() }
+		return rej,e
+	})
+	c.Quit()
+	return err
+}
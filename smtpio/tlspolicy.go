@@ -0,0 +1,325 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package smtpio
+
+import "github.com/emersion/go-smtp"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/sha256"
+import "crypto/sha512"
+import "bytes"
+import "bufio"
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "strconv"
+import "strings"
+
+type TLSMode int
+const (
+	// Never use STARTTLS.
+	TLSNone TLSMode = iota
+
+	// Use STARTTLS if offered. The certificate is verified against ServerName.
+	TLSOpportunistic
+
+	// Require STARTTLS and a certificate valid for the host name.
+	TLSRequired
+
+	// Require STARTTLS and a server certificate whose SubjectPublicKeyInfo
+	// matches one of the pinned SHA-256 fingerprints. Only the leaf is checked,
+	// as the peer may append any certificate to the chain.
+	TLSPinned
+
+	// Require STARTTLS and a certificate matching the TLSA records (RFC 7672).
+	TLSDane
+
+	// Apply a MTA-STS policy (RFC 8461).
+	TLSMtaSts
+)
+
+/*
+A TLSA resource record.
+*/
+type TLSA struct{
+	Usage, Selector, MatchingType uint8
+	Data []byte
+}
+
+/*
+Looks up the TLSA records of a SMTP server. The resolver is responsible for
+DNSSEC validation; it must only return authenticated records.
+*/
+type TLSAResolver interface{
+	LookupTLSA(host string, port int) ([]TLSA, error)
+}
+
+/*
+A MTA-STS policy (RFC 8461).
+*/
+type MTASTSPolicy struct{
+	Version string
+	Mode string // "enforce", "testing" or "none"
+	MX []string
+	MaxAge int
+}
+
+/*
+A TLS policy for one destination.
+*/
+type TLSPolicy struct{
+	Mode TLSMode
+
+	// Used by TLSPinned: SHA-256 hashes of the SubjectPublicKeyInfo of the
+	// server certificate.
+	Pins [][]byte
+
+	// Used by TLSDane.
+	Resolver TLSAResolver
+
+	// Used by TLSMtaSts.
+	MTASTS *MTASTSPolicy
+
+	// Root CAs for certificate verification. If nil, the system roots are used.
+	RootCAs *x509.CertPool
+
+	// Called with the failures, that a MTA-STS policy in testing mode only
+	// reports (for example to a TLSRPT reporter). May be nil.
+	Report func(hostname string, err error)
+}
+
+var (
+	EInvalidMTASTS = errors.New("Invalid MTA-STS policy")
+)
+
+/*
+Creates a policy failure. Policy failures are temporary delivery errors.
+*/
+func tlsPolicyError(format string, args ...interface{}) error {
+	return &smtp.SMTPError{Code:421, Message:"4.7.10 TLS policy: "+fmt.Sprintf(format,args...)}
+}
+
+/*
+Parses a MTA-STS policy file.
+*/
+func ParseMTASTSPolicy(r io.Reader) (p *MTASTSPolicy,err error) {
+	p = new(MTASTSPolicy)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line=="" { continue }
+		i := strings.IndexByte(line,':')
+		if i<0 { p = nil; err = EInvalidMTASTS; return }
+		k,v := strings.TrimSpace(line[:i]),strings.TrimSpace(line[i+1:])
+		switch k {
+		case "version": p.Version = v
+		case "mode": p.Mode = v
+		case "mx": p.MX = append(p.MX,v)
+		case "max_age":
+			p.MaxAge,err = strconv.Atoi(v)
+			if err!=nil { p = nil; return }
+		}
+	}
+	err = s.Err()
+	if err!=nil { p = nil; return }
+	if p.Version!="STSv1" { p = nil; err = EInvalidMTASTS; return }
+	switch p.Mode {
+	case "enforce","testing","none":
+	default: p = nil; err = EInvalidMTASTS
+	}
+	return
+}
+
+/*
+Loads a MTA-STS policy file.
+*/
+func LoadMTASTSPolicy(name string) (*MTASTSPolicy, error) {
+	f,err := os.Open(name)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	return ParseMTASTSPolicy(f)
+}
+
+/*
+Reports, whether the host name matches one of the mx patterns of the policy.
+*/
+func (p *MTASTSPolicy) Matches(hostname string) bool {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname,"."))
+	for _,mx := range p.MX {
+		mx = strings.ToLower(strings.TrimSuffix(mx,"."))
+		if strings.HasPrefix(mx,"*.") {
+			// The wildcard matches exactly one label.
+			i := strings.IndexByte(hostname,'.')
+			if i>0 && hostname[i:]==mx[1:] { return true }
+		} else if mx==hostname {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TLSA) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch t.Selector {
+	case 0: data = cert.Raw
+	case 1: data = cert.RawSubjectPublicKeyInfo
+	default: return false
+	}
+	switch t.MatchingType {
+	case 0:
+	case 1: h := sha256.Sum256(data); data = h[:]
+	case 2: h := sha512.Sum512(data); data = h[:]
+	default: return false
+	}
+	return bytes.Equal(data,t.Data)
+}
+
+func parseChain(rawCerts [][]byte) (certs []*x509.Certificate,err error) {
+	certs = make([]*x509.Certificate,len(rawCerts))
+	for i,raw := range rawCerts {
+		certs[i],err = x509.ParseCertificate(raw)
+		if err!=nil { return }
+	}
+	if len(certs)==0 { err = errors.New("no certificate") }
+	return
+}
+
+/*
+Verifies a certificate chain against TLSA records. Only DANE-TA(2) and
+DANE-EE(3) are usable for SMTP (RFC 7672 section 3.1.3).
+*/
+func verifyDane(records []TLSA, hostname string, rawCerts [][]byte) error {
+	certs,err := parseChain(rawCerts)
+	if err!=nil { return err }
+	for _,r := range records {
+		switch r.Usage {
+		case 3:
+			// Name checks and expiry are not applied to DANE-EE.
+			if r.matches(certs[0]) { return nil }
+		case 2:
+			for _,ta := range certs[1:] {
+				if !r.matches(ta) { continue }
+				roots := x509.NewCertPool()
+				roots.AddCert(ta)
+				inter := x509.NewCertPool()
+				for _,c := range certs[1:] { inter.AddCert(c) }
+				_,err = certs[0].Verify(x509.VerifyOptions{DNSName:hostname,Roots:roots,Intermediates:inter})
+				if err==nil { return nil }
+			}
+		}
+	}
+	return errors.New("no TLSA record matches the certificate")
+}
+
+/*
+Matches the pins against the leaf certificate.
+*/
+func verifyPins(pins [][]byte, rawCerts [][]byte) error {
+	certs,err := parseChain(rawCerts)
+	if err!=nil { return err }
+	h := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+	for _,pin := range pins {
+		if bytes.Equal(h[:],pin) { return nil }
+	}
+	return errors.New("server certificate does not match a pinned key")
+}
+
+/*
+Verifies a certificate chain against the roots and the host name.
+*/
+func verifyChain(roots *x509.CertPool, hostname string, rawCerts [][]byte) error {
+	certs,err := parseChain(rawCerts)
+	if err!=nil { return err }
+	inter := x509.NewCertPool()
+	for _,c := range certs[1:] { inter.AddCert(c) }
+	_,err = certs[0].Verify(x509.VerifyOptions{DNSName:hostname,Roots:roots,Intermediates:inter})
+	return err
+}
+
+func (p *TLSPolicy) report(hostname string, err error) {
+	if p.Report!=nil { p.Report(hostname,err) }
+}
+
+/*
+Returns the TLS configuration for a host and whether STARTTLS is required. A
+nil config means, that STARTTLS is not used.
+*/
+func (p *TLSPolicy) config(hostname string, port int) (config *tls.Config, required bool, err error) {
+	mode := TLSOpportunistic
+	if p!=nil { mode = p.Mode }
+	config = &tls.Config{ServerName: hostname}
+	if p!=nil { config.RootCAs = p.RootCAs }
+	required = true
+	switch mode {
+	case TLSNone:
+		config = nil
+	case TLSOpportunistic:
+		required = false
+	case TLSRequired:
+	case TLSPinned:
+		if len(p.Pins)==0 { return nil,false,tlsPolicyError("no pins for %s",hostname) }
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPins(p.Pins,rawCerts)
+		}
+	case TLSDane:
+		if p.Resolver==nil { return nil,false,tlsPolicyError("no TLSA resolver") }
+		records,e := p.Resolver.LookupTLSA(hostname,port)
+		if e!=nil { return nil,false,tlsPolicyError("TLSA lookup for %s failed: %v",hostname,e) }
+		usable := records[:0:0]
+		for _,r := range records {
+			if r.Usage==2 || r.Usage==3 { usable = append(usable,r) }
+		}
+		if len(usable)==0 { return nil,false,tlsPolicyError("no usable TLSA records for %s",hostname) }
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyDane(usable,hostname,rawCerts)
+		}
+	case TLSMtaSts:
+		if p.MTASTS==nil { return nil,false,tlsPolicyError("no MTA-STS policy") }
+		switch p.MTASTS.Mode {
+		case "enforce":
+			if !p.MTASTS.Matches(hostname) { return nil,false,tlsPolicyError("%s is not listed in the MTA-STS policy",hostname) }
+		case "testing":
+			// Failures are reported, but do not stop the delivery (RFC 8461,
+			// section 5).
+			required = false
+			if !p.MTASTS.Matches(hostname) { p.report(hostname,fmt.Errorf("%s is not listed in the MTA-STS policy",hostname)) }
+			config.InsecureSkipVerify = true
+			config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if e := verifyChain(p.RootCAs,hostname,rawCerts); e!=nil { p.report(hostname,e) }
+				return nil
+			}
+		default:
+			required = false
+			config.InsecureSkipVerify = true
+		}
+	default:
+		return nil,false,tlsPolicyError("unknown mode %d",mode)
+	}
+	return
+}
+
+/*
+Negotiates TLS on a connection according to the policy. It must be called
+before AUTH and MAIL FROM. A nil policy means TLSOpportunistic.
+*/
+func (p *TLSPolicy) apply(c *smtp.Client, hostname string, port int) error {
+	config,required,err := p.config(hostname,port)
+	if err!=nil || config==nil { return err }
+	if ok,_ := c.Extension("STARTTLS"); !ok {
+		if required { return tlsPolicyError("%s does not offer STARTTLS",hostname) }
+		if p!=nil && p.Mode==TLSMtaSts && p.MTASTS.Mode=="testing" { p.report(hostname,fmt.Errorf("%s does not offer STARTTLS",hostname)) }
+		return nil
+	}
+	err = c.StartTLS(config)
+	if err!=nil && required { return tlsPolicyError("%v",err) }
+	return err
+}
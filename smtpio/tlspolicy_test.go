@@ -0,0 +1,165 @@
+/*
+  Copyright (C) 2018 Simon Schmidt
+
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+
+package smtpio
+
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/sha256"
+import "crypto/sha512"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "math/big"
+import "net"
+import "strings"
+import "testing"
+import "time"
+
+/*
+Creates a certificate for name, signed by parent, or self-signed if parent is
+nil.
+*/
+func newCert(t *testing.T,name string,isCA bool,parent *x509.Certificate,parentKey *ecdsa.PrivateKey) (*x509.Certificate,*ecdsa.PrivateKey) {
+	key,err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+	if err!=nil { t.Fatal(err) }
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{CommonName:name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+	}
+	if isCA {
+		tmpl.IsCA,tmpl.BasicConstraintsValid = true,true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+	if parent==nil { parent,parentKey = tmpl,key }
+	raw,err := x509.CreateCertificate(rand.Reader,tmpl,parent,&key.PublicKey,parentKey)
+	if err!=nil { t.Fatal(err) }
+	c,err := x509.ParseCertificate(raw)
+	if err!=nil { t.Fatal(err) }
+	return c,key
+}
+
+func selfSigned(t *testing.T,name string) (raw []byte,pin []byte) {
+	c,_ := newCert(t,name,false,nil,nil)
+	h := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return c.Raw,h[:]
+}
+
+func TestVerifyPins(t *testing.T) {
+	real,pin := selfSigned(t,"mx.example.org")
+	evil,_ := selfSigned(t,"mx.example.org")
+	pins := [][]byte{pin}
+	
+	if err := verifyPins(pins,[][]byte{real}); err!=nil { t.Fatal(err) }
+	
+	// A MITM presenting its own leaf with the pinned certificate appended.
+	if err := verifyPins(pins,[][]byte{evil,real}); err==nil { t.Fatal("pin matched a certificate other than the leaf") }
+	if err := verifyPins(pins,nil); err==nil { t.Fatal("empty chain accepted") }
+}
+
+func TestVerifyDane(t *testing.T) {
+	ee,_ := newCert(t,"mx.example.org",false,nil,nil)
+	spki := sha256.Sum256(ee.RawSubjectPublicKeyInfo)
+	full := sha512.Sum512(ee.Raw)
+	chain := [][]byte{ee.Raw}
+	for _,r := range []TLSA{{3,1,1,spki[:]},{3,0,0,ee.Raw},{3,0,2,full[:]}} {
+		if err := verifyDane([]TLSA{r},"mx.example.org",chain); err!=nil { t.Errorf("%d %d %d: %v",r.Usage,r.Selector,r.MatchingType,err) }
+	}
+	// DANE-EE ignores the name.
+	if err := verifyDane([]TLSA{{3,1,1,spki[:]}},"other.example.org",chain); err!=nil { t.Error(err) }
+	if err := verifyDane([]TLSA{{3,1,1,full[:32]}},"mx.example.org",chain); err==nil { t.Error("wrong digest matched") }
+	// PKIX-EE(1) is not usable for SMTP.
+	if err := verifyDane([]TLSA{{1,1,1,spki[:]}},"mx.example.org",chain); err==nil { t.Error("PKIX-EE accepted") }
+	
+	ca,caKey := newCert(t,"Example CA",true,nil,nil)
+	leaf,_ := newCert(t,"mx.example.org",false,ca,caKey)
+	ta := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	records := []TLSA{{2,1,1,ta[:]}}
+	if err := verifyDane(records,"mx.example.org",[][]byte{leaf.Raw,ca.Raw}); err!=nil { t.Fatal(err) }
+	if err := verifyDane(records,"mx.example.org",[][]byte{leaf.Raw}); err==nil { t.Error("trust anchor missing from the chain") }
+	if err := verifyDane(records,"other.example.org",[][]byte{leaf.Raw,ca.Raw}); err==nil { t.Error("DANE-TA accepted a wrong name") }
+}
+
+func TestParseMTASTSPolicy(t *testing.T) {
+	p,err := ParseMTASTSPolicy(strings.NewReader("version: STSv1\r\nmode: enforce\r\nmx: mx.example.org\r\nmx: *.example.net\r\nmax_age: 86400\r\n"))
+	if err!=nil { t.Fatal(err) }
+	if p.Mode!="enforce" || p.MaxAge!=86400 || len(p.MX)!=2 || p.MX[1]!="*.example.net" { t.Fatalf("%+v",p) }
+	for _,bad := range []string{
+		"mode: enforce\nmx: mx.example.org\n",
+		"version: STSv1\nmode: strict\n",
+		"version: STSv1\nmode: enforce\nmax_age: forever\n",
+		"version: STSv1\nmode: enforce\nno colon\n",
+	} {
+		if p,err := ParseMTASTSPolicy(strings.NewReader(bad)); err==nil || p!=nil { t.Errorf("%q accepted",bad) }
+	}
+}
+
+func TestMTASTSMatches(t *testing.T) {
+	p := &MTASTSPolicy{MX:[]string{"mx.example.org","*.example.net."}}
+	for host,want := range map[string]bool{
+		"mx.example.org": true,
+		"MX.Example.Org.": true,
+		"mx2.example.org": false,
+		"a.example.net": true,
+		"a.b.example.net": false,
+		"example.net": false,
+	} {
+		if p.Matches(host)!=want { t.Errorf("%s: %v",host,!want) }
+	}
+}
+
+/*
+Performs a TLS handshake with a server, that presents a self-signed
+certificate.
+*/
+func handshake(t *testing.T,config *tls.Config) error {
+	c,key := newCert(t,"mx.example.org",false,nil,nil)
+	l,err := net.Listen("tcp","127.0.0.1:0")
+	if err!=nil { t.Fatal(err) }
+	defer l.Close()
+	go func() {
+		conn,err := l.Accept()
+		if err!=nil { return }
+		s := tls.Server(conn,&tls.Config{Certificates:[]tls.Certificate{{Certificate:[][]byte{c.Raw},PrivateKey:key}}})
+		s.Handshake()
+		s.Close()
+	}()
+	conn,err := net.Dial("tcp",l.Addr().String())
+	if err!=nil { t.Fatal(err) }
+	defer conn.Close()
+	return tls.Client(conn,config).Handshake()
+}
+
+func TestMTASTSModes(t *testing.T) {
+	var reports []error
+	p := &TLSPolicy{Mode:TLSMtaSts,MTASTS:&MTASTSPolicy{Version:"STSv1",Mode:"enforce",MX:[]string{"mx.example.org"}}}
+	p.Report = func(host string,err error) { reports = append(reports,err) }
+	
+	config,required,err := p.config("mx.example.org",25)
+	if err!=nil || !required { t.Fatal(required,err) }
+	if handshake(t,config)==nil { t.Fatal("enforce mode accepted an untrusted certificate") }
+	if _,_,err = p.config("evil.example.org",25); err==nil { t.Fatal("enforce mode accepted an unlisted host") }
+	
+	// Testing mode delivers anyway and reports the failures.
+	p.MTASTS.Mode = "testing"
+	config,required,err = p.config("evil.example.org",25)
+	if err!=nil || required { t.Fatal(required,err) }
+	if err = handshake(t,config); err!=nil { t.Fatal(err) }
+	if len(reports)!=2 { t.Fatalf("reports %v",reports) }
+	
+	reports = nil
+	p.MTASTS.Mode = "none"
+	config,required,err = p.config("evil.example.org",25)
+	if err!=nil || required { t.Fatal(required,err) }
+	if err = handshake(t,config); err!=nil || len(reports)!=0 { t.Fatal(err,reports) }
+}